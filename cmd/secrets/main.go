@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"process-payments/internal/secrets"
+)
+
+// Encrypts a JSON object of secrets into a file readable by the encrypted secret provider.
+//
+//	go run ./cmd/secrets -genkey
+//	SECRETS_KEY=... go run ./cmd/secrets -in secrets.json -out secrets.enc
+func main() {
+	genKey := flag.Bool("genkey", false, "print a new base64 encoded encryption key")
+	in := flag.String("in", "secrets.json", "JSON object of secret names and values to encrypt")
+	out := flag.String("out", "secrets.enc", "encrypted secrets file to write")
+	flag.Parse()
+
+	if *genKey {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			exit(err)
+		}
+		fmt.Println(base64.StdEncoding.EncodeToString(key))
+		return
+	}
+
+	aead, err := secrets.NewCipher(os.Getenv("SECRETS_KEY"))
+	if err != nil {
+		exit(err)
+	}
+
+	data, err := os.ReadFile(*in)
+	if err != nil {
+		exit(err)
+	}
+	var values map[string]string
+	if err := json.Unmarshal(data, &values); err != nil {
+		exit(err)
+	}
+
+	encrypted, err := secrets.Encrypt(aead, values)
+	if err != nil {
+		exit(err)
+	}
+	if err := os.WriteFile(*out, encrypted, 0o600); err != nil {
+		exit(err)
+	}
+	fmt.Printf("Encrypted %d secrets into %s\n", len(values), *out)
+}
+
+func exit(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
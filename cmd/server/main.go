@@ -1,37 +1,107 @@
 package main
 
 import (
-	"log"
+	"context"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
 	"process-payments/internal/config"
 	"process-payments/internal/database"
+	"process-payments/internal/logger"
 	"process-payments/internal/repository"
 	"process-payments/internal/server"
 	"process-payments/internal/services"
+	"process-payments/internal/tracing"
 
 	"github.com/joho/godotenv"
 )
 
 func main() {
-	// Load environment variables from .env file
+	// Load environment variables from the optional .env file
 	err := godotenv.Load(".env")
-	if err != nil {
-		log.Fatalf("Error loading .env file: %v", err)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.Error("error loading .env file", "error", err)
+		os.Exit(1)
 	}
 
-	// Load config
+	// Load config, from the optional config file and the environment variables
 	cfg := config.GetConfig()
+	if err := cfg.Validate(); err != nil {
+		slog.Error("invalid configuration:\n" + err.Error())
+		os.Exit(1)
+	}
+
+	// Structured logging, JSON in production
+	logger.Init(cfg.Production)
+
+	// Tracing, exported over OTLP, to stdout or disabled
+	shutdownTracing, err := tracing.Init(context.Background(), cfg.AppName, cfg.Tracing)
+	if err != nil {
+		slog.Error("error initializing tracing", "error", err)
+		os.Exit(1)
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			slog.Error("error shutting down tracing", "error", err)
+		}
+	}()
 
 	// Load database
-	cfg.MongoClient = database.DBInstance(cfg)
+	cfg.MongoClient, err = database.DBInstance(cfg)
+	if err != nil {
+		slog.Error("error loading database", "error", err)
+		os.Exit(1)
+	}
 
 	//Initialize collections
+	idempotencyRepository, err := repository.NewMongoIdempotencyRepository(context.Background(), database.OpenCollection(cfg.MongoClient, cfg.Mongo.Database, "idempotencyKeys"))
+	if err != nil {
+		slog.Error("error initializing idempotency keys collection", "error", err)
+		os.Exit(1)
+	}
+	paymentRepository, err := repository.NewMongoPaymentRepository(context.Background(), database.OpenCollection(cfg.MongoClient, cfg.Mongo.Database, "transactions"), repository.PausedAccess(cfg.Subscriptions.PausedAccess), repository.PendingAccess(cfg.Subscriptions.PendingAccess))
+	if err != nil {
+		slog.Error("error initializing transactions collection", "error", err)
+		os.Exit(1)
+	}
+	checkoutRepository, err := repository.NewMongoCheckoutRepository(context.Background(), database.OpenCollection(cfg.MongoClient, cfg.Mongo.Database, "checkoutSessions"))
+	if err != nil {
+		slog.Error("error initializing checkout sessions collection", "error", err)
+		os.Exit(1)
+	}
 	cfg.Collections = &repository.Collections{
-		PaymentCollection: repository.NewMongoPaymentRepository(database.OpenCollection(cfg.MongoClient, "transactions")),
+		PaymentCollection:     paymentRepository,
+		IdempotencyCollection: idempotencyRepository,
+		TrialCollection:       repository.NewMongoTrialRepository(database.OpenCollection(cfg.MongoClient, cfg.Mongo.Database, "trialUsages"), database.OpenCollection(cfg.MongoClient, cfg.Mongo.Database, "trialOverrides")),
+		CheckoutCollection:    checkoutRepository,
 	}
 
 	//Initialize Services
+	var notifier services.Notifier
+	if cfg.Notifications.WebhookURL != "" {
+		notifier = services.NewWebhookNotifier(cfg.Notifications.WebhookURL, cfg.SecretProvider)
+	}
+	stripeService := services.NewStripeService(cfg.SecretProvider, services.StripeSettings{
+		Products:                 cfg.Products,
+		TrialDays:                cfg.Subscriptions.TrialDays,
+		GracePeriod:              cfg.Subscriptions.GracePeriod,
+		ProductSettings:          cfg.ProductSettingsMap(),
+		DefaultProrationBehavior: cfg.PlanChanges.ProrationBehavior,
+		ProrationBehaviors:       cfg.PlanChanges.ProrationBehaviors(),
+		Regions:                  cfg.Pricing.PricingRegions(),
+		Tax:                      cfg.Tax.Settings(),
+		CheckoutRecovery:         cfg.Checkout.Recovery,
+	}, cfg.Production, cfg.Collections, notifier)
+	if err := stripeService.ValidateProducts(context.Background()); err != nil {
+		slog.Error("invalid configuration:\n" + err.Error())
+		os.Exit(1)
+	}
+	webhookQueue := services.NewWebhookQueue(stripeService.HandleEvents, cfg.Webhook.Workers, cfg.Webhook.QueueSize)
+	webhookQueue.Start()
 	cfg.Services = &services.Services{
-		StripeService: services.NewStripeService(cfg.ENV.STRIPE_SECRET_KEY, cfg.ENV.STRIPE_WEBHOOK_SECRET_KEY, cfg.Products, cfg.Production, cfg.Collections),
+		StripeService: stripeService,
+		WebhookQueue:  webhookQueue,
 	}
 
 	cfg.UpdateConfig()
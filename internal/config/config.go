@@ -1,73 +1,498 @@
 package config
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
 	"os"
+	"path"
+	"process-payments/internal/ratelimit"
 	"process-payments/internal/repository"
+	"process-payments/internal/secrets"
 	"process-payments/internal/services"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"go.mongodb.org/mongo-driver/mongo"
+	"gopkg.in/yaml.v3"
 )
 
+// DefaultConfigFile is read when CONFIG_FILE is not set. It is optional, defaults and env vars are enough to run.
+const DefaultConfigFile = "config.yaml"
+
 type Config struct {
-	AppName     string
-	Production  bool
-	Port        string
-	ClientURL   string
-	ENV         ENV
-	MongoClient *mongo.Client
-	Collections *repository.Collections
-	Services    *services.Services
-	Products    []string
+	AppName       string              `yaml:"appName"`
+	Production    bool                `yaml:"production"`
+	Port          string              `yaml:"port"`
+	AdminPort     string              `yaml:"adminPort"`
+	ClientURL     string              `yaml:"clientUrl"`
+	Tracing       string              `yaml:"tracing"`
+	TLS           TLSConfig           `yaml:"tls"`
+	Mongo         MongoConfig         `yaml:"mongo"`
+	Stripe        StripeConfig        `yaml:"stripe"`
+	Secrets       secrets.Config      `yaml:"secrets"`
+	CORS          CORSConfig          `yaml:"cors"`
+	Subscriptions SubscriptionsConfig `yaml:"subscriptions"`
+	Webhook       WebhookConfig       `yaml:"webhook"`
+	RateLimit     RateLimitConfig     `yaml:"rateLimit"`
+	Products      []string            `yaml:"products"`
+	// ProductSettings holds the billing rules of the products that don't use the defaults, by product ID
+	ProductSettings map[string]ProductConfig `yaml:"productSettings"`
+	PlanChanges     PlanChangesConfig        `yaml:"planChanges"`
+	Pricing         PricingConfig            `yaml:"pricing"`
+	Tax             TaxConfig                `yaml:"tax"`
+	Checkout        CheckoutConfig           `yaml:"checkout"`
+	Notifications   NotificationsConfig      `yaml:"notifications"`
+
+	// SecretProvider gives the current value of the Stripe keys and MongoDB URI, they may be rotated while running
+	SecretProvider secrets.Provider        `yaml:"-"`
+	MongoClient    *mongo.Client           `yaml:"-"`
+	Collections    *repository.Collections `yaml:"-"`
+	Services       *services.Services      `yaml:"-"`
+
+	// loadErrs holds the problems met while loading, reported by Validate
+	loadErrs []error
+	// validation holds the result of the last Validate, reported by CheckRuntime without validating again
+	validation error
+	validated  bool
+}
+
+type TLSConfig struct {
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+	// ClientCAFile enables mutual TLS on the admin server and the internal routes
+	ClientCAFile string `yaml:"clientCaFile"`
+}
+
+// Enabled reports whether the servers are served over TLS
+func (t TLSConfig) Enabled() bool {
+	return t.CertFile != "" && t.KeyFile != ""
+}
+
+type MongoConfig struct {
+	URI      string `yaml:"uri"`
+	Database string `yaml:"database"`
+}
+
+type StripeConfig struct {
+	SecretKey        string `yaml:"secretKey"`
+	WebhookSecretKey string `yaml:"webhookSecretKey"`
 }
 
-type ENV struct {
-	PORT                      string
-	MONGO_URI                 string
-	PRODUCTION                bool
-	STRIPE_WEBHOOK_SECRET_KEY string
-	STRIPE_SECRET_KEY         string
+type CORSConfig struct {
+	// DevOrigins are the origins allowed outside production, ClientURL is the only one allowed in production
+	DevOrigins []string `yaml:"devOrigins"`
+}
+
+type SubscriptionsConfig struct {
+	TrialDays int64 `yaml:"trialDays"`
+	// GracePeriod is added to the end of each paid period, invoices sometimes take a while to be processed
+	GracePeriod time.Duration `yaml:"gracePeriod"`
+	// PausedAccess is deny, paid_period or allow, whether subscriptions with paused billing grant access
+	PausedAccess string `yaml:"pausedAccess"`
+	// PendingAccess is deny or allow, whether purchases waiting for a delayed payment, such as a SEPA Debit, grant access
+	PendingAccess string `yaml:"pendingAccess"`
+}
+
+type WebhookConfig struct {
+	Workers   int `yaml:"workers"`
+	QueueSize int `yaml:"queueSize"`
+}
+
+type RateLimitConfig struct {
+	// Store is memory, or mongo to share the limits between replicas
+	Store string `yaml:"store"`
+	// Groups holds the limits of each route group, such as checkout or catalog
+	Groups map[string]RateLimitGroupConfig `yaml:"groups"`
+}
+
+type RateLimitGroupConfig struct {
+	PerUser LimitConfig `yaml:"perUser"`
+	PerIP   LimitConfig `yaml:"perIp"`
+}
+
+// LimitConfig allows Requests per Period, with bursts of up to Burst requests. A zero value disables the limit.
+type LimitConfig struct {
+	Requests int           `yaml:"requests"`
+	Period   time.Duration `yaml:"period"`
+	Burst    int           `yaml:"burst"`
+}
+
+func (l LimitConfig) Limit() ratelimit.Limit {
+	return ratelimit.Every(l.Requests, l.Period, l.Burst)
+}
+
+type ProductConfig struct {
+	// Group gathers the products a user should only hold once, such as the tiers of a plan. Defaults to the product ID.
+	Group string `yaml:"group"`
+	// ExistingSubscription is allow, block or change, applied when the user already has a valid subscription in the group
+	ExistingSubscription string `yaml:"existingSubscription"`
+	// TrialDays is the trial length of the product when its prices and metadata don't set one
+	TrialDays int64 `yaml:"trialDays"`
+	// CardlessTrial starts trials without a payment method, TrialEndBehavior (cancel or pause) applies when none was added
+	CardlessTrial    bool   `yaml:"cardlessTrial"`
+	TrialEndBehavior string `yaml:"trialEndBehavior"`
+	// AllowPromotionCodes lets users type a promotion code on the payment page when the checkout has none
+	AllowPromotionCodes bool `yaml:"allowPromotionCodes"`
+}
+
+func (p ProductConfig) Settings() services.ProductSettings {
+	return services.ProductSettings{
+		Group:                p.Group,
+		ExistingSubscription: services.ExistingSubscriptionPolicy(p.ExistingSubscription),
+		TrialDays:            p.TrialDays,
+		CardlessTrial:        p.CardlessTrial,
+		TrialEndBehavior:     p.TrialEndBehavior,
+		AllowPromotionCodes:  p.AllowPromotionCodes,
+	}
+}
+
+// ProductSettingsMap returns the billing rules of the products for the StripeService
+func (c *Config) ProductSettingsMap() map[string]services.ProductSettings {
+	settings := make(map[string]services.ProductSettings, len(c.ProductSettings))
+	for productId, product := range c.ProductSettings {
+		settings[productId] = product.Settings()
+	}
+	return settings
+}
+
+type PlanChangesConfig struct {
+	// ProrationBehavior is create_prorations, always_invoice or none, used by the product pairs without their own rule
+	ProrationBehavior string `yaml:"prorationBehavior"`
+	// Pairs holds the proration behavior of the changes from one product to another
+	Pairs []PlanChangePairConfig `yaml:"pairs"`
+}
+
+type PlanChangePairConfig struct {
+	From              string `yaml:"from"`
+	To                string `yaml:"to"`
+	ProrationBehavior string `yaml:"prorationBehavior"`
+}
+
+// ProrationBehaviors returns the proration behavior of each configured product pair for the StripeService
+func (p PlanChangesConfig) ProrationBehaviors() map[services.ProductPair]string {
+	behaviors := make(map[services.ProductPair]string, len(p.Pairs))
+	for _, pair := range p.Pairs {
+		behaviors[services.ProductPair{From: pair.From, To: pair.To}] = pair.ProrationBehavior
+	}
+	return behaviors
+}
+
+type PricingConfig struct {
+	// GeoHeader is the request header holding the country of the client IP, set by our CDN such as CF-IPCountry.
+	// It is only read when set, clients could send it themselves when the API is not behind the CDN.
+	GeoHeader string `yaml:"geoHeader"`
+	// Regions sell the products at local prices to the customers of their countries
+	Regions []RegionConfig `yaml:"regions"`
+}
+
+type RegionConfig struct {
+	Name      string   `yaml:"name"`
+	Countries []string `yaml:"countries"`
+	// Currency picks the product price with the same billing interval in this currency
+	Currency string `yaml:"currency"`
+	// Prices replaces prices by regional ones, by price ID, such as cheaper prices for purchasing-power parity
+	Prices map[string]string `yaml:"prices"`
+}
+
+// PricingRegions returns the regional prices for the StripeService
+func (p PricingConfig) PricingRegions() []services.PricingRegion {
+	regions := make([]services.PricingRegion, 0, len(p.Regions))
+	for _, region := range p.Regions {
+		regions = append(regions, services.PricingRegion{
+			Name:      region.Name,
+			Countries: region.Countries,
+			Currency:  region.Currency,
+			Prices:    region.Prices,
+		})
+	}
+	return regions
+}
+
+type TaxConfig struct {
+	// Automatic enables Stripe Tax on checkouts, it must be set up in the Stripe dashboard first
+	Automatic bool `yaml:"automatic"`
+	// CollectTaxIds lets businesses give their tax ID on the payment page
+	CollectTaxIds bool `yaml:"collectTaxIds"`
+}
+
+func (t TaxConfig) Settings() services.TaxSettings {
+	return services.TaxSettings{
+		Automatic:     t.Automatic,
+		CollectTaxIds: t.CollectTaxIds,
+	}
+}
+
+type CheckoutConfig struct {
+	// ReturnOrigins are the origins success and cancel URLs may use besides ClientURL, such as https://www.example.com.
+	// An origin without host, such as myapp://, allows every URL of a mobile app scheme.
+	ReturnOrigins []string `yaml:"returnOrigins"`
+	// ReturnPaths are the path patterns success and cancel URLs may use, in path.Match syntax such as /onboarding/*.
+	// Every path is allowed when empty.
+	ReturnPaths []string `yaml:"returnPaths"`
+	// Recovery asks Stripe for a recovery URL of the abandoned checkouts, listed to let users finish their purchase
+	Recovery bool `yaml:"recovery"`
+}
+
+type NotificationsConfig struct {
+	// WebhookURL receives the notifications of the users as JSON, such as a failed payment, they are only logged when empty
+	WebhookURL string `yaml:"webhookUrl"`
 }
 
 var configInstance *Config
 var once sync.Once
 
-// The function `ConvertStringToBool` converts a string to a boolean value in Go.
-func convertStringToBool(str string) bool {
-	value, err := strconv.ParseBool(str)
-	if err != nil {
-		log.Fatal(err)
+// Configuration errors
+var (
+	ErrReadingConfigFile             = errors.New("error reading config file")
+	ErrParsingConfigFile             = errors.New("error parsing config file")
+	ErrInvalidEnvVar                 = errors.New("invalid environment variable")
+	ErrLoadingSecrets                = errors.New("error loading secrets")
+	ErrMissingStripeSecretKey        = errors.New("stripe.secretKey (STRIPE_SECRET_KEY) is required")
+	ErrMissingStripeWebhookSecretKey = errors.New("stripe.webhookSecretKey (STRIPE_WEBHOOK_SECRET_KEY) is required")
+	ErrMissingMongoURI               = errors.New("mongo.uri (MONGO_URI) is required")
+	ErrMissingMongoDatabase          = errors.New("mongo.database (MONGO_DATABASE) is required")
+	ErrMissingClientURL              = errors.New("clientUrl (CLIENT_URL) is required in production")
+	ErrMalformedURL                  = errors.New("malformed URL")
+	ErrInvalidPort                   = errors.New("invalid port")
+	ErrIncompleteTLS                 = errors.New("tls.certFile (TLS_CERT_FILE) and tls.keyFile (TLS_KEY_FILE) must be set together")
+	ErrClientCAWithoutTLS            = errors.New("tls.clientCaFile (TLS_CLIENT_CA_FILE) requires tls.certFile and tls.keyFile")
+	ErrMissingFile                   = errors.New("file not found")
+	ErrInvalidTracingExporter        = errors.New("tracing (TRACING_EXPORTER) must be otlp, stdout or none")
+	ErrNoProducts                    = errors.New("products (PRODUCTS) must list at least one product")
+	ErrInvalidProductId              = errors.New("invalid product ID")
+	ErrDuplicateProductId            = errors.New("duplicate product ID")
+	ErrUnlistedProductSettings       = errors.New("product is not listed in products (PRODUCTS)")
+	ErrInvalidExistingSubscription   = errors.New("existingSubscription must be allow, block or change")
+	ErrInvalidProductTrialDays       = errors.New("trialDays must not be negative")
+	ErrInvalidTrialEndBehavior       = errors.New("trialEndBehavior must be cancel or pause")
+	ErrInvalidProrationBehavior      = errors.New("prorationBehavior must be create_prorations, always_invoice or none")
+	ErrMissingRegionName             = errors.New("name is required")
+	ErrDuplicateRegionName           = errors.New("duplicate region name")
+	ErrInvalidCountry                = errors.New("countries must be ISO 3166-1 alpha-2 codes such as FR")
+	ErrDuplicateCountry              = errors.New("country is already in another region")
+	ErrInvalidCurrency               = errors.New("currency must be a lowercase ISO 4217 code such as eur")
+	ErrInvalidPriceId                = errors.New("invalid price ID")
+	ErrInvalidReturnOrigin           = errors.New("return origins must be a scheme and host without path, such as https://www.example.com or myapp://")
+	ErrInvalidReturnPathPattern      = errors.New("return paths must be path patterns starting with /, such as /onboarding/*")
+	ErrInvalidTrialDays              = errors.New("subscriptions.trialDays (TRIAL_DAYS) must not be negative")
+	ErrInvalidGracePeriod            = errors.New("subscriptions.gracePeriod (GRACE_PERIOD) must not be negative")
+	ErrInvalidPausedAccess           = errors.New("subscriptions.pausedAccess (PAUSED_ACCESS) must be deny, paid_period or allow")
+	ErrInvalidPendingAccess          = errors.New("subscriptions.pendingAccess (PENDING_ACCESS) must be deny or allow")
+	ErrInvalidRateLimitStore         = errors.New("rateLimit.store (RATE_LIMIT_STORE) must be memory or mongo")
+	ErrInvalidRateLimit              = errors.New("rate limit requests, period and burst must not be negative")
+	ErrInvalidWebhookQueue           = errors.New("webhook.workers (WEBHOOK_WORKERS) and webhook.queueSize (WEBHOOK_QUEUE_SIZE) must be positive")
+)
+
+// defaultConfig returns the settings used when neither the config file nor the env vars set them
+func defaultConfig() *Config {
+	return &Config{
+		AppName:   "ProcessPaymentsAPI",
+		Port:      "8080",
+		AdminPort: "9090",
+		Tracing:   "none",
+		Secrets: secrets.Config{
+			Provider: secrets.ProviderEnv,
+			Dir:      "/run/secrets",
+		},
+		Mongo: MongoConfig{
+			Database: "processPayments",
+		},
+		CORS: CORSConfig{
+			DevOrigins: []string{"http://127.0.0.1:3000", "http://localhost:3000"},
+		},
+		Subscriptions: SubscriptionsConfig{
+			TrialDays:     14,
+			GracePeriod:   12 * time.Hour,
+			PausedAccess:  string(repository.PausedAccessPaidPeriod),
+			PendingAccess: string(repository.PendingAccessDeny),
+		},
+		Webhook: WebhookConfig{
+			Workers:   4,
+			QueueSize: 100,
+		},
+		RateLimit: RateLimitConfig{
+			Store: ratelimit.StoreMemory,
+			Groups: map[string]RateLimitGroupConfig{
+				"checkout": {
+					PerUser: LimitConfig{Requests: 5, Period: time.Minute, Burst: 5},
+					PerIP:   LimitConfig{Requests: 20, Period: time.Minute, Burst: 10},
+				},
+				"catalog": {
+					PerIP: LimitConfig{Requests: 60, Period: time.Minute, Burst: 20},
+				},
+			},
+		},
+		Products: []string{"prod_S6WxyFWfWVsP60"},
+		PlanChanges: PlanChangesConfig{
+			ProrationBehavior: services.ProrationCreateProrations,
+		},
 	}
-	return value
 }
 
+// LoadConfig builds the configuration from the defaults, then the config file, then the env vars.
+// Loading never stops on a problem, they are all reported by Validate.
 func LoadConfig() *Config {
-	prod := convertStringToBool(os.Getenv("PRODUCTION"))
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
-	}
-
-	configInstance = &Config{
-		AppName:    "ProcessPaymentsAPI",
-		Production: prod,
-		Port:       port,
-		ClientURL:  os.Getenv("CLIENT_URL"),
-		ENV: ENV{
-			PORT:                      port,
-			MONGO_URI:                 os.Getenv("MONGO_URI"),                 // MongoDB URI
-			PRODUCTION:                prod,                                   // Production flag
-			STRIPE_WEBHOOK_SECRET_KEY: os.Getenv("STRIPE_WEBHOOK_SECRET_KEY"), // Stripe Webhook Secret Key
-			STRIPE_SECRET_KEY:         os.Getenv("STRIPE_SECRET_KEY"),         // Stripe Secret Key
-		},
-		Products: []string{"prod_S6WxyFWfWVsP60"},
+	cfg := defaultConfig()
+
+	path, explicit := os.LookupEnv("CONFIG_FILE")
+	if !explicit {
+		path = DefaultConfigFile
 	}
+	cfg.loadFile(path, explicit)
+	cfg.loadEnv()
+	cfg.loadSecrets()
 
+	configInstance = cfg
 	return configInstance
 }
 
+// loadFile reads the YAML config file at path. A missing file is only an error when it was explicitly asked for.
+func (c *Config) loadFile(path string, required bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) && !required {
+			return
+		}
+		c.loadErrs = append(c.loadErrs, fmt.Errorf("%w %s: %v", ErrReadingConfigFile, path, err))
+		return
+	}
+
+	if err := yaml.Unmarshal(data, c); err != nil {
+		c.loadErrs = append(c.loadErrs, fmt.Errorf("%w %s: %v", ErrParsingConfigFile, path, err))
+	}
+}
+
+// loadEnv overrides the settings with the env vars that are set
+func (c *Config) loadEnv() {
+	c.envString("PORT", &c.Port)
+	c.envString("ADMIN_PORT", &c.AdminPort)
+	c.envBool("PRODUCTION", &c.Production)
+	c.envString("CLIENT_URL", &c.ClientURL)
+	c.envString("TRACING_EXPORTER", &c.Tracing)
+	c.envString("TLS_CERT_FILE", &c.TLS.CertFile)
+	c.envString("TLS_KEY_FILE", &c.TLS.KeyFile)
+	c.envString("TLS_CLIENT_CA_FILE", &c.TLS.ClientCAFile)
+	c.envString("MONGO_DATABASE", &c.Mongo.Database)
+	c.envString("SECRETS_PROVIDER", &c.Secrets.Provider)
+	c.envString("SECRETS_DIR", &c.Secrets.Dir)
+	c.envString("SECRETS_FILE", &c.Secrets.File)
+	c.envString("SECRETS_KEY_FILE", &c.Secrets.KeyFile)
+	c.envList("CORS_DEV_ORIGINS", &c.CORS.DevOrigins)
+	c.envInt64("TRIAL_DAYS", &c.Subscriptions.TrialDays)
+	c.envDuration("GRACE_PERIOD", &c.Subscriptions.GracePeriod)
+	c.envString("PAUSED_ACCESS", &c.Subscriptions.PausedAccess)
+	c.envString("PENDING_ACCESS", &c.Subscriptions.PendingAccess)
+	c.envInt("WEBHOOK_WORKERS", &c.Webhook.Workers)
+	c.envInt("WEBHOOK_QUEUE_SIZE", &c.Webhook.QueueSize)
+	c.envString("RATE_LIMIT_STORE", &c.RateLimit.Store)
+	c.envList("PRODUCTS", &c.Products)
+	c.envString("PRORATION_BEHAVIOR", &c.PlanChanges.ProrationBehavior)
+	c.envString("GEO_HEADER", &c.Pricing.GeoHeader)
+	c.envList("CHECKOUT_RETURN_ORIGINS", &c.Checkout.ReturnOrigins)
+	c.envList("CHECKOUT_RETURN_PATHS", &c.Checkout.ReturnPaths)
+	c.envBool("CHECKOUT_RECOVERY", &c.Checkout.Recovery)
+	c.envString("NOTIFICATIONS_WEBHOOK_URL", &c.Notifications.WebhookURL)
+	c.envBool("AUTOMATIC_TAX", &c.Tax.Automatic)
+	c.envBool("COLLECT_TAX_IDS", &c.Tax.CollectTaxIds)
+}
+
+// loadSecrets creates the secret provider and reads the secrets through it.
+// Secrets unknown to the provider keep the value set in the config file.
+func (c *Config) loadSecrets() {
+	provider, err := secrets.New(c.Secrets)
+	if err != nil {
+		c.loadErrs = append(c.loadErrs, fmt.Errorf("%w: %v", ErrLoadingSecrets, err))
+		return
+	}
+	c.SecretProvider = secrets.WithFallback(provider, map[string]string{
+		secrets.StripeSecretKey:        c.Stripe.SecretKey,
+		secrets.StripeWebhookSecretKey: c.Stripe.WebhookSecretKey,
+		secrets.MongoURI:               c.Mongo.URI,
+	})
+
+	c.secret(secrets.StripeSecretKey, &c.Stripe.SecretKey)
+	c.secret(secrets.StripeWebhookSecretKey, &c.Stripe.WebhookSecretKey)
+	c.secret(secrets.MongoURI, &c.Mongo.URI)
+}
+
+func (c *Config) secret(name string, target *string) {
+	value, err := c.SecretProvider.Get(context.Background(), name)
+	if err != nil {
+		if !errors.Is(err, secrets.ErrSecretNotFound) {
+			c.loadErrs = append(c.loadErrs, fmt.Errorf("%w: %v", ErrLoadingSecrets, err))
+		}
+		return
+	}
+	*target = value
+}
+
+func (c *Config) envString(name string, target *string) {
+	if value, ok := os.LookupEnv(name); ok && value != "" {
+		*target = value
+	}
+}
+
+func (c *Config) envBool(name string, target *bool) {
+	if value, ok := os.LookupEnv(name); ok && value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			c.loadErrs = append(c.loadErrs, fmt.Errorf("%w %s=%q: must be a boolean", ErrInvalidEnvVar, name, value))
+			return
+		}
+		*target = parsed
+	}
+}
+
+func (c *Config) envInt(name string, target *int) {
+	if value, ok := os.LookupEnv(name); ok && value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			c.loadErrs = append(c.loadErrs, fmt.Errorf("%w %s=%q: must be an integer", ErrInvalidEnvVar, name, value))
+			return
+		}
+		*target = parsed
+	}
+}
+
+func (c *Config) envInt64(name string, target *int64) {
+	if value, ok := os.LookupEnv(name); ok && value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			c.loadErrs = append(c.loadErrs, fmt.Errorf("%w %s=%q: must be an integer", ErrInvalidEnvVar, name, value))
+			return
+		}
+		*target = parsed
+	}
+}
+
+func (c *Config) envDuration(name string, target *time.Duration) {
+	if value, ok := os.LookupEnv(name); ok && value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			c.loadErrs = append(c.loadErrs, fmt.Errorf("%w %s=%q: must be a duration such as 12h", ErrInvalidEnvVar, name, value))
+			return
+		}
+		*target = parsed
+	}
+}
+
+// envList reads a comma separated list
+func (c *Config) envList(name string, target *[]string) {
+	if value, ok := os.LookupEnv(name); ok && value != "" {
+		var list []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		*target = list
+	}
+}
+
 func GetConfig() *Config {
 	once.Do(func() {
 		configInstance = LoadConfig()
@@ -78,3 +503,268 @@ func GetConfig() *Config {
 func (c *Config) UpdateConfig() {
 	configInstance = c
 }
+
+// Validate checks the configuration and returns every problem found, one per line
+func (c *Config) Validate() error {
+	errs := append([]error{}, c.loadErrs...)
+
+	if c.Stripe.SecretKey == "" {
+		errs = append(errs, ErrMissingStripeSecretKey)
+	}
+	if c.Stripe.WebhookSecretKey == "" {
+		errs = append(errs, ErrMissingStripeWebhookSecretKey)
+	}
+
+	if c.Mongo.URI == "" {
+		errs = append(errs, ErrMissingMongoURI)
+	} else if !strings.HasPrefix(c.Mongo.URI, "mongodb://") && !strings.HasPrefix(c.Mongo.URI, "mongodb+srv://") {
+		// The URI is not printed, it usually holds credentials
+		errs = append(errs, fmt.Errorf("mongo.uri (MONGO_URI): %w: scheme must be mongodb or mongodb+srv", ErrMalformedURL))
+	}
+	if c.Mongo.Database == "" {
+		errs = append(errs, ErrMissingMongoDatabase)
+	}
+
+	if c.ClientURL == "" {
+		if c.Production {
+			errs = append(errs, ErrMissingClientURL)
+		}
+	} else if err := validateURL(c.ClientURL, "http", "https"); err != nil {
+		errs = append(errs, fmt.Errorf("clientUrl (CLIENT_URL): %w", err))
+	}
+	if c.Notifications.WebhookURL != "" {
+		if err := validateURL(c.Notifications.WebhookURL, "http", "https"); err != nil {
+			errs = append(errs, fmt.Errorf("notifications.webhookUrl (NOTIFICATIONS_WEBHOOK_URL): %w", err))
+		}
+	}
+	for _, origin := range c.CORS.DevOrigins {
+		if err := validateURL(origin, "http", "https"); err != nil {
+			errs = append(errs, fmt.Errorf("cors.devOrigins (CORS_DEV_ORIGINS): %w", err))
+		}
+	}
+
+	if err := validatePort(c.Port); err != nil {
+		errs = append(errs, fmt.Errorf("port (PORT): %w", err))
+	}
+	if err := validatePort(c.AdminPort); err != nil {
+		errs = append(errs, fmt.Errorf("adminPort (ADMIN_PORT): %w", err))
+	}
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		errs = append(errs, ErrIncompleteTLS)
+	}
+	if c.TLS.ClientCAFile != "" && !c.TLS.Enabled() {
+		errs = append(errs, ErrClientCAWithoutTLS)
+	}
+	for _, file := range []string{c.TLS.CertFile, c.TLS.KeyFile, c.TLS.ClientCAFile} {
+		if _, err := os.Stat(file); file != "" && err != nil {
+			errs = append(errs, fmt.Errorf("tls: %w %q", ErrMissingFile, file))
+		}
+	}
+
+	switch c.Tracing {
+	case "otlp", "stdout", "none":
+	default:
+		errs = append(errs, ErrInvalidTracingExporter)
+	}
+
+	if len(c.Products) == 0 {
+		errs = append(errs, ErrNoProducts)
+	}
+	seen := make(map[string]bool, len(c.Products))
+	for _, productId := range c.Products {
+		if !strings.HasPrefix(productId, "prod_") {
+			errs = append(errs, fmt.Errorf("products (PRODUCTS): %w %q, Stripe product IDs start with prod_", ErrInvalidProductId, productId))
+		}
+		if seen[productId] {
+			errs = append(errs, fmt.Errorf("products (PRODUCTS): %w %q", ErrDuplicateProductId, productId))
+		}
+		seen[productId] = true
+	}
+	for productId, product := range c.ProductSettings {
+		if !seen[productId] {
+			errs = append(errs, fmt.Errorf("productSettings.%s: %w", productId, ErrUnlistedProductSettings))
+		}
+		switch services.ExistingSubscriptionPolicy(product.ExistingSubscription) {
+		case "", services.PolicyAllow, services.PolicyBlock, services.PolicyChange:
+		default:
+			errs = append(errs, fmt.Errorf("productSettings.%s: %w", productId, ErrInvalidExistingSubscription))
+		}
+		if product.TrialDays < 0 {
+			errs = append(errs, fmt.Errorf("productSettings.%s: %w", productId, ErrInvalidProductTrialDays))
+		}
+		switch product.TrialEndBehavior {
+		case "", services.TrialEndCancel, services.TrialEndPause:
+		default:
+			errs = append(errs, fmt.Errorf("productSettings.%s: %w", productId, ErrInvalidTrialEndBehavior))
+		}
+	}
+
+	if !validProrationBehavior(c.PlanChanges.ProrationBehavior) {
+		errs = append(errs, fmt.Errorf("planChanges (PRORATION_BEHAVIOR): %w", ErrInvalidProrationBehavior))
+	}
+	for i, pair := range c.PlanChanges.Pairs {
+		if !seen[pair.From] || !seen[pair.To] {
+			errs = append(errs, fmt.Errorf("planChanges.pairs[%d]: %w", i, ErrUnlistedProductSettings))
+		}
+		if !validProrationBehavior(pair.ProrationBehavior) {
+			errs = append(errs, fmt.Errorf("planChanges.pairs[%d]: %w", i, ErrInvalidProrationBehavior))
+		}
+	}
+
+	regionNames := make(map[string]bool, len(c.Pricing.Regions))
+	regionCountries := make(map[string]bool)
+	for i, region := range c.Pricing.Regions {
+		if region.Name == "" {
+			errs = append(errs, fmt.Errorf("pricing.regions[%d]: %w", i, ErrMissingRegionName))
+		} else if regionNames[region.Name] {
+			errs = append(errs, fmt.Errorf("pricing.regions[%d]: %w %q", i, ErrDuplicateRegionName, region.Name))
+		}
+		regionNames[region.Name] = true
+		for _, country := range region.Countries {
+			if !validCode(country, 'A', 'Z', 2) {
+				errs = append(errs, fmt.Errorf("pricing.regions[%d]: %w, got %q", i, ErrInvalidCountry, country))
+			} else if regionCountries[country] {
+				errs = append(errs, fmt.Errorf("pricing.regions[%d]: %w %q", i, ErrDuplicateCountry, country))
+			}
+			regionCountries[country] = true
+		}
+		if region.Currency != "" && !validCode(region.Currency, 'a', 'z', 3) {
+			errs = append(errs, fmt.Errorf("pricing.regions[%d]: %w", i, ErrInvalidCurrency))
+		}
+		for priceId, regionalPriceId := range region.Prices {
+			for _, id := range []string{priceId, regionalPriceId} {
+				if !strings.HasPrefix(id, "price_") {
+					errs = append(errs, fmt.Errorf("pricing.regions[%d].prices: %w %q, Stripe price IDs start with price_", i, ErrInvalidPriceId, id))
+				}
+			}
+		}
+	}
+
+	for _, origin := range c.Checkout.ReturnOrigins {
+		parsed, err := url.Parse(origin)
+		webWithoutHost := parsed != nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host == ""
+		if err != nil || parsed.Scheme == "" || webWithoutHost || strings.Trim(parsed.Path, "/") != "" || parsed.RawQuery != "" || parsed.User != nil {
+			errs = append(errs, fmt.Errorf("checkout.returnOrigins (CHECKOUT_RETURN_ORIGINS): %w, got %q", ErrInvalidReturnOrigin, origin))
+		}
+	}
+	for _, pattern := range c.Checkout.ReturnPaths {
+		if _, err := path.Match(pattern, ""); err != nil || !strings.HasPrefix(pattern, "/") {
+			errs = append(errs, fmt.Errorf("checkout.returnPaths (CHECKOUT_RETURN_PATHS): %w, got %q", ErrInvalidReturnPathPattern, pattern))
+		}
+	}
+
+	if c.Subscriptions.TrialDays < 0 {
+		errs = append(errs, ErrInvalidTrialDays)
+	}
+	if c.Subscriptions.GracePeriod < 0 {
+		errs = append(errs, ErrInvalidGracePeriod)
+	}
+	switch repository.PausedAccess(c.Subscriptions.PausedAccess) {
+	case repository.PausedAccessDeny, repository.PausedAccessPaidPeriod, repository.PausedAccessAllow:
+	default:
+		errs = append(errs, ErrInvalidPausedAccess)
+	}
+	switch repository.PendingAccess(c.Subscriptions.PendingAccess) {
+	case repository.PendingAccessDeny, repository.PendingAccessAllow:
+	default:
+		errs = append(errs, ErrInvalidPendingAccess)
+	}
+	switch c.RateLimit.Store {
+	case ratelimit.StoreMemory, ratelimit.StoreMongo:
+	default:
+		errs = append(errs, ErrInvalidRateLimitStore)
+	}
+	for group, limits := range c.RateLimit.Groups {
+		for keyType, limit := range map[string]LimitConfig{"perUser": limits.PerUser, "perIp": limits.PerIP} {
+			if limit.Requests < 0 || limit.Period < 0 || limit.Burst < 0 {
+				errs = append(errs, fmt.Errorf("rateLimit.groups.%s.%s: %w", group, keyType, ErrInvalidRateLimit))
+			}
+		}
+	}
+
+	if c.Webhook.Workers < 1 || c.Webhook.QueueSize < 1 {
+		errs = append(errs, ErrInvalidWebhookQueue)
+	}
+
+	c.validation, c.validated = errors.Join(errs...), true
+	return c.validation
+}
+
+// CheckRuntime reports the result of the startup validation and checks again what can change while running:
+// the secrets, which may be rotated, and the TLS files, which are reloaded when they change
+func (c *Config) CheckRuntime(ctx context.Context) error {
+	if !c.validated {
+		c.Validate()
+	}
+	errs := []error{c.validation}
+
+	if c.SecretProvider != nil {
+		for _, secret := range []struct {
+			name string
+			err  error
+		}{
+			{name: secrets.StripeSecretKey, err: ErrMissingStripeSecretKey},
+			{name: secrets.StripeWebhookSecretKey, err: ErrMissingStripeWebhookSecretKey},
+		} {
+			if _, err := c.SecretProvider.Get(ctx, secret.name); errors.Is(err, secrets.ErrSecretNotFound) {
+				errs = append(errs, secret.err)
+			} else if err != nil {
+				errs = append(errs, fmt.Errorf("%w: %v", ErrLoadingSecrets, err))
+			}
+		}
+	}
+	for _, file := range []string{c.TLS.CertFile, c.TLS.KeyFile, c.TLS.ClientCAFile} {
+		if _, err := os.Stat(file); file != "" && err != nil {
+			errs = append(errs, fmt.Errorf("tls: %w %q", ErrMissingFile, file))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func validProrationBehavior(behavior string) bool {
+	switch behavior {
+	case services.ProrationCreateProrations, services.ProrationAlwaysInvoice, services.ProrationNone:
+		return true
+	default:
+		return false
+	}
+}
+
+// validCode checks that code is made of length letters between first and last, such as a country or currency code
+func validCode(code string, first, last byte, length int) bool {
+	if len(code) != length {
+		return false
+	}
+	for i := 0; i < len(code); i++ {
+		if code[i] < first || code[i] > last {
+			return false
+		}
+	}
+	return true
+}
+
+// validateURL checks that raw is an absolute URL using one of the given schemes
+func validateURL(raw string, schemes ...string) error {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedURL, err)
+	}
+	if parsed.Host == "" {
+		return fmt.Errorf("%w %q: missing host", ErrMalformedURL, raw)
+	}
+	for _, scheme := range schemes {
+		if parsed.Scheme == scheme {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w %q: scheme must be one of %s", ErrMalformedURL, raw, strings.Join(schemes, ", "))
+}
+
+func validatePort(port string) error {
+	value, err := strconv.Atoi(port)
+	if err != nil || value < 1 || value > 65535 {
+		return fmt.Errorf("%w %q", ErrInvalidPort, port)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package controllers
+
+import (
+	"process-payments/internal/config"
+	"process-payments/internal/database"
+	"process-payments/internal/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Check statuses
+const (
+	checkOK     = "ok"
+	checkFailed = "failed"
+)
+
+// Healthz The `Healthz` function is a controller answering liveness probes, it only tells the process is alive.
+func Healthz() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		utils.SendResponse(c, true, 200, "", "Alive", gin.H{"status": checkOK})
+	}
+}
+
+// Readyz The `Readyz` function is a controller answering readiness probes.
+// The service is ready when MongoDB answers, the configuration is valid and the webhook queue has room left.
+// The configuration is not validated again, only the secrets and TLS files that can change while running are checked.
+func Readyz() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := config.GetConfig()
+		ready := true
+
+		mongoCheck := gin.H{"status": checkOK}
+		if err := database.Ping(c.Request.Context(), cfg.MongoClient); err != nil {
+			ready = false
+			mongoCheck = gin.H{"status": checkFailed, "error": err.Error()}
+		}
+
+		configCheck := gin.H{"status": checkOK}
+		if err := cfg.CheckRuntime(c.Request.Context()); err != nil {
+			ready = false
+			configCheck = gin.H{"status": checkFailed, "error": err.Error()}
+		}
+
+		queue := cfg.Services.WebhookQueue
+		queueCheck := gin.H{"status": checkOK, "length": queue.Len(), "capacity": queue.Cap()}
+		if queue.Saturated() {
+			ready = false
+			queueCheck["status"] = checkFailed
+			queueCheck["error"] = "webhook queue is saturated"
+		}
+
+		checks := gin.H{
+			"mongo":        mongoCheck,
+			"config":       configCheck,
+			"webhookQueue": queueCheck,
+		}
+		if !ready {
+			utils.SendResponse(c, false, 503, "Service is not ready", "Not ready", gin.H{"checks": checks})
+			return
+		}
+		utils.SendResponse(c, true, 200, "", "Ready", gin.H{"checks": checks})
+	}
+}
@@ -0,0 +1,83 @@
+package controllers
+
+import (
+	"errors"
+	"process-payments/internal/config"
+	"process-payments/internal/logger"
+	"process-payments/internal/models"
+	"process-payments/internal/repository"
+	"process-payments/internal/utils"
+	"process-payments/pkg/types"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetTrialEligibility The `GetTrialEligibility` function is a controller that tells whether a user can start a trial,
+// and whether an admin override decided it.
+func GetTrialEligibility() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := config.GetConfig()
+		userId := c.Param("userId")
+		ctx := logger.With(c.Request.Context(), "userId", userId)
+
+		eligibility, err := cfg.Services.StripeService.UserTrialEligibility(ctx, userId)
+		if err != nil {
+			utils.SendResponse(c, false, 500, err.Error(), "Error getting trial eligibility", nil)
+			return
+		}
+		utils.SendResponse(c, true, 200, "", "Trial eligibility retrieved successfully", eligibility)
+	}
+}
+
+// SetTrialOverride The `SetTrialOverride` function is a controller that lets an admin make a user eligible or not for trials,
+// whatever trials the user already had.
+func SetTrialOverride() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := config.GetConfig()
+		userId := c.Param("userId")
+		ctx := logger.With(c.Request.Context(), "userId", userId)
+
+		var body types.TrialOverrideBody
+		if err := c.ShouldBindJSON(&body); err != nil {
+			utils.SendResponse(c, false, 400, err.Error(), "Error setting trial override", nil)
+			return
+		}
+
+		override := &models.TrialOverride{
+			UserId:    userId,
+			Eligible:  *body.Eligible,
+			Reason:    body.Reason,
+			CreatedAt: time.Now(),
+		}
+		if err := cfg.Collections.TrialCollection.SetOverride(ctx, override); err != nil {
+			logger.FromContext(ctx).Error("error setting trial override", "error", err)
+			utils.SendResponse(c, false, 500, "Error setting trial override", "Error setting trial override", nil)
+			return
+		}
+		logger.FromContext(ctx).Info("trial override set", "eligible", override.Eligible, "reason", override.Reason)
+		utils.SendResponse(c, true, 200, "", "Trial override set successfully", override)
+	}
+}
+
+// DeleteTrialOverride The `DeleteTrialOverride` function is a controller that removes the admin override of a user,
+// the trials the user already had decide again.
+func DeleteTrialOverride() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := config.GetConfig()
+		userId := c.Param("userId")
+		ctx := logger.With(c.Request.Context(), "userId", userId)
+
+		err := cfg.Collections.TrialCollection.DeleteOverride(ctx, userId)
+		if err != nil {
+			if errors.Is(err, repository.ErrTrialOverrideNotFound) {
+				utils.SendResponse(c, false, 404, err.Error(), "Error deleting trial override", nil)
+				return
+			}
+			logger.FromContext(ctx).Error("error deleting trial override", "error", err)
+			utils.SendResponse(c, false, 500, "Error deleting trial override", "Error deleting trial override", nil)
+			return
+		}
+		utils.SendResponse(c, true, 200, "", "Trial override deleted successfully", nil)
+	}
+}
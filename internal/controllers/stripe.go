@@ -1,14 +1,44 @@
 package controllers
 
 import (
-	"log"
+	"cmp"
+	"context"
+	"errors"
+	"net/url"
+	"path"
 	"process-payments/internal/config"
+	"process-payments/internal/logger"
+	"process-payments/internal/metrics"
+	"process-payments/internal/repository"
+	"process-payments/internal/services"
 	"process-payments/internal/utils"
 	"process-payments/pkg/types"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
 
+// Checkout request errors
+var (
+	ErrInvalidReturnPath    = errors.New("must be a path of the client application starting with /, or a URL")
+	ErrReturnURLNotAllowed  = errors.New("origin or path is not allowed, see checkout.returnOrigins and checkout.returnPaths")
+	ErrSessionIdInCancelURL = errors.New("cancel URL can't hold " + sessionIdPlaceholder + ", Stripe only fills it in success and return URLs")
+)
+
+// Placeholders substituted in the success, cancel and return URLs of checkouts
+const (
+	// sessionIdPlaceholder is replaced with the checkout session ID
+	sessionIdPlaceholder = "{SESSION_ID}"
+	// statusPlaceholder is replaced with success or cancel, so that one page can handle both
+	statusPlaceholder = "{STATUS}"
+)
+
+// Checkout return statuses, substituted for statusPlaceholder
+const (
+	returnStatusSuccess = "success"
+	returnStatusCancel  = "cancel"
+)
+
 // HandleStripeWebhooks The `HandleStripeWebhooks` function is a controller that handles webhook requests from Stripe.
 func HandleStripeWebhooks() gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -16,15 +46,19 @@ func HandleStripeWebhooks() gin.HandlerFunc {
 
 		stripeService := cfg.Services.StripeService
 		event, err := stripeService.AuthenticateWebhook(c)
-		if err == nil {
-			go func() {
-				err := stripeService.HandleEvents(event)
-				if err != nil {
-					log.Println("Error handling stripe event: ", err.Error())
-				}
-			}()
-		} else {
+		if err != nil {
 			utils.SendResponse(c, false, 400, err.Error(), "Webhook is not valid", nil)
+			return
+		}
+		metrics.WebhookEventsTotal.WithLabelValues(string(event.Type), metrics.WebhookReceived).Inc()
+
+		// The event is handled after the response is sent, keep the request values (logger, trace) but not its cancellation
+		ctx := context.WithoutCancel(c.Request.Context())
+		if err := cfg.Services.WebhookQueue.Enqueue(ctx, event); err != nil {
+			// Stripe retries webhooks answered with an error, let it deliver the event again later
+			logger.FromContext(ctx).Warn("webhook queue is full", "eventId", event.ID, "eventType", string(event.Type))
+			utils.SendResponse(c, false, 503, err.Error(), "Webhook could not be queued", nil)
+			return
 		}
 		utils.SendResponse(c, true, 200, "", "Webhook received successfully", nil)
 	}
@@ -45,23 +79,380 @@ func CreateStripeCheckout() gin.HandlerFunc {
 			utils.SendResponse(c, false, 400, "userId is required", "Error getting checkout session", nil)
 			return
 		}
+		successURL, err := returnURL(cfg, c.Query("successUrl"), returnStatusSuccess)
+		if err != nil {
+			utils.SendResponse(c, false, 400, "successUrl: "+err.Error(), "Error getting checkout session", nil)
+			return
+		}
+		cancelURL, err := returnURL(cfg, c.Query("cancelUrl"), returnStatusCancel)
+		if err != nil {
+			utils.SendResponse(c, false, 400, "cancelUrl: "+err.Error(), "Error getting checkout session", nil)
+			return
+		}
+		ctx := logger.With(c.Request.Context(), "userId", userId)
 
 		//Construct StripeCheckoutRequest
+		stripeService := cfg.Services.StripeService
 		stripeCheckoutRequest := types.StripeCheckoutRequest{
-			UserId:    userId,
-			ProductId: productId,
-			ReturnURL: cfg.ClientURL + "/account",
+			UserId:        userId,
+			ProductId:     productId,
+			PriceId:       c.Query("priceId"),
+			PromotionCode: c.Query("promoCode"),
+			Country:       c.Query("country"),
+			IPCountry:     geoCountry(c, cfg),
+			SuccessURL:    withSessionId(successURL),
+			CancelURL:     cancelURL,
 		}
 
-		stripeService := cfg.Services.StripeService
-		session, err := stripeService.GetCheckoutSession(stripeCheckoutRequest)
+		result, err := stripeService.GetCheckoutSession(ctx, stripeCheckoutRequest)
+		var existingErr *services.ExistingSubscriptionError
+		if errors.As(err, &existingErr) {
+			sendExistingSubscription(c, existingErr, "Error getting checkout session")
+			return
+		}
+		if err != nil && checkoutErrorStatus(err) == 400 {
+			utils.SendResponse(c, false, 400, err.Error(), "Error getting checkout session", nil)
+			return
+		}
 		if err != nil {
 			utils.SendResponse(c, false, 400, "Error getting checkout session", "Error getting checkout session", nil)
 			return
 		}
 		utils.SendResponse(c, true, 200, "", "Checkout session retrieved successfully", gin.H{
-			"sessionId": session.ID,
-			"url":       string(session.URL),
+			"sessionId": result.Session.ID,
+			"url":       string(result.Session.URL),
+		})
+	}
+}
+
+// CreateCheckout The `CreateCheckout` function is a controller that creates a Stripe checkout session from a JSON body.
+// Requests sent with an Idempotency-Key header are replayed by the idempotency middleware, the key is also passed to Stripe.
+func CreateCheckout() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := config.GetConfig()
+		userId := c.GetString("userId")
+		if userId == "" {
+			utils.SendResponse(c, false, 400, "userId is required", "Error creating checkout session", nil)
+			return
+		}
+
+		var body types.CreateCheckoutBody
+		if err := c.ShouldBindJSON(&body); err != nil {
+			utils.SendResponse(c, false, 400, err.Error(), "Error creating checkout session", nil)
+			return
+		}
+
+		successURL, err := returnURL(cfg, cmp.Or(body.SuccessURL, body.SuccessPath), returnStatusSuccess)
+		if err != nil {
+			utils.SendResponse(c, false, 400, "successUrl: "+err.Error(), "Error creating checkout session", nil)
+			return
+		}
+		cancelURL, err := returnURL(cfg, cmp.Or(body.CancelURL, body.CancelPath), returnStatusCancel)
+		if err != nil {
+			utils.SendResponse(c, false, 400, "cancelUrl: "+err.Error(), "Error creating checkout session", nil)
+			return
+		}
+		embeddedReturnURL, err := returnURL(cfg, cmp.Or(body.ReturnURL, body.ReturnPath), returnStatusSuccess)
+		if err != nil {
+			utils.SendResponse(c, false, 400, "returnUrl: "+err.Error(), "Error creating checkout session", nil)
+			return
+		}
+		ctx := logger.With(c.Request.Context(), "userId", userId)
+
+		stripeService := cfg.Services.StripeService
+		stripeCheckoutRequest := types.StripeCheckoutRequest{
+			UserId:         userId,
+			ProductId:      body.ProductId,
+			PriceId:        body.PriceId,
+			Quantity:       body.Quantity,
+			Items:          body.Items,
+			PromotionCode:  body.PromoCode,
+			Country:        body.Country,
+			IPCountry:      geoCountry(c, cfg),
+			UIMode:         body.UIMode,
+			ReturnURL:      withSessionId(embeddedReturnURL),
+			SuccessURL:     withSessionId(successURL),
+			CancelURL:      cancelURL,
+			IdempotencyKey: c.GetString("idempotencyKey"),
+		}
+
+		result, err := stripeService.GetCheckoutSession(ctx, stripeCheckoutRequest)
+		var existingErr *services.ExistingSubscriptionError
+		if errors.As(err, &existingErr) {
+			sendExistingSubscription(c, existingErr, "Error creating checkout session")
+			return
+		}
+		if err != nil {
+			utils.SendResponse(c, false, checkoutErrorStatus(err), err.Error(), "Error creating checkout session", nil)
+			return
+		}
+		utils.SendResponse(c, true, 201, "", "Checkout session created successfully", gin.H{
+			"sessionId":    result.Session.ID,
+			"uiMode":       result.Session.UIMode,
+			"url":          result.Session.URL,
+			"clientSecret": result.Session.ClientSecret,
 		})
 	}
 }
+
+// GetCheckoutStatus The `GetCheckoutStatus` function is a controller that returns the status of a checkout session of the user,
+// and whether its subscription or purchase is already recorded. Sessions of other users answer 404.
+func GetCheckoutStatus() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := config.GetConfig()
+		userId := c.GetString("userId")
+		sessionId := c.Param("sessionId")
+		if userId == "" {
+			utils.SendResponse(c, false, 400, "userId is required", "Error getting checkout status", nil)
+			return
+		}
+		ctx := logger.With(c.Request.Context(), "userId", userId, "sessionId", sessionId)
+
+		status, err := cfg.Services.StripeService.GetCheckoutStatus(ctx, userId, sessionId)
+		if err != nil {
+			utils.SendResponse(c, false, checkoutStatusErrorStatus(err), err.Error(), "Error getting checkout status", nil)
+			return
+		}
+		utils.SendResponse(c, true, 200, "", "Checkout status retrieved successfully", status)
+	}
+}
+
+// FulfillCheckout The `FulfillCheckout` function is a controller called by the client when the user comes back from a checkout,
+// with the session_id of the success URL. It records the subscription or purchase when the webhook didn't yet, so access is granted right away.
+func FulfillCheckout() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := config.GetConfig()
+		userId := c.GetString("userId")
+		sessionId := c.Param("sessionId")
+		if userId == "" {
+			utils.SendResponse(c, false, 400, "userId is required", "Error fulfilling checkout", nil)
+			return
+		}
+		ctx := logger.With(c.Request.Context(), "userId", userId, "sessionId", sessionId)
+
+		status, err := cfg.Services.StripeService.FulfillCheckout(ctx, userId, sessionId)
+		if err != nil {
+			utils.SendResponse(c, false, checkoutStatusErrorStatus(err), err.Error(), "Error fulfilling checkout", nil)
+			return
+		}
+		utils.SendResponse(c, true, 200, "", "Checkout fulfilled successfully", status)
+	}
+}
+
+// checkoutStatusErrorStatus maps the checkout status errors to the HTTP status answered to the client
+func checkoutStatusErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, services.ErrCheckoutSessionNotFound):
+		return 404
+	case errors.Is(err, services.ErrCheckoutNotComplete):
+		return 409
+	case errors.Is(err, services.ErrCheckingFulfillment),
+		errors.Is(err, services.ErrorSavingOneTimePurchase),
+		errors.Is(err, repository.ErrorUpdatingSubscription):
+		return 500
+	default:
+		return 502
+	}
+}
+
+// GetCatalog The `GetCatalog` function is a controller that lists the sold products with every active price,
+// so the client can let the user choose one, such as a monthly or an annual price.
+// Prices are localized for the country query param, the billing address of the user or the CDN country.
+func GetCatalog() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := config.GetConfig()
+		ctx := c.Request.Context()
+
+		stripeService := cfg.Services.StripeService
+		country := stripeService.ResolveCountry(ctx, c.GetString("userId"), c.Query("country"), geoCountry(c, cfg))
+		catalog, err := stripeService.GetCatalog(ctx, country)
+		if err != nil {
+			utils.SendResponse(c, false, 502, err.Error(), "Error getting catalog", nil)
+			return
+		}
+		utils.SendResponse(c, true, 200, "", "Catalog retrieved successfully", catalog)
+	}
+}
+
+// geoCountry returns the country of the client IP set by our CDN, empty when no geo header is configured
+func geoCountry(c *gin.Context, cfg *config.Config) string {
+	if cfg.Pricing.GeoHeader == "" {
+		return ""
+	}
+	return c.GetHeader(cfg.Pricing.GeoHeader)
+}
+
+// sendExistingSubscription answers a checkout refused because the user already has a valid subscription in the product group.
+// The client can send the user to the billing portal to manage it instead, or to the plan change when one is offered.
+func sendExistingSubscription(c *gin.Context, err *services.ExistingSubscriptionError, message string) {
+	data := gin.H{
+		"code":             "existing_subscription",
+		"subscriptionId":   err.SubscriptionId,
+		"productId":        err.ProductId,
+		"billingPortalUrl": err.BillingPortalURL,
+	}
+	if err.PlanChange != nil {
+		// The body to send to the preview route, then to the change route once the user confirms
+		planPath := "/api/stripe/subscriptions/" + url.PathEscape(err.SubscriptionId) + "/plan"
+		data["planChange"] = gin.H{
+			"previewUrl": planPath + "/preview",
+			"changeUrl":  planPath,
+			"body": gin.H{
+				"productId": err.PlanChange.ProductId,
+				"priceId":   err.PlanChange.PriceId,
+				"quantity":  err.PlanChange.Quantity,
+			},
+		}
+	}
+	utils.SendResponse(c, false, 409, err.Error(), message, data)
+}
+
+// checkoutErrorStatus maps the checkout creation errors to the HTTP status answered to the client
+func checkoutErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, services.ErrUnknownProduct),
+		errors.Is(err, services.ErrPriceNotInProduct),
+		errors.Is(err, services.ErrEmptyCart),
+		errors.Is(err, services.ErrDuplicateCartItem),
+		errors.Is(err, services.ErrInvalidQuantityBounds),
+		errors.Is(err, services.ErrMixedBillingIntervals),
+		errors.Is(err, services.ErrMixedCurrencies),
+		errors.Is(err, services.ErrPriceNotInRegion),
+		errors.Is(err, services.ErrInvalidUIMode),
+		errors.Is(err, services.ErrInvalidReturnURL),
+		errors.Is(err, services.ErrPromotionCodeNotFound),
+		errors.Is(err, services.ErrPromotionCodeInactive),
+		errors.Is(err, services.ErrPromotionCodeExpired),
+		errors.Is(err, services.ErrPromotionCodeMaxRedemptions),
+		errors.Is(err, services.ErrPromotionCodeNotApplicable),
+		errors.Is(err, services.ErrPromotionCodeMinimumAmount),
+		errors.Is(err, services.ErrPromotionCodeCustomerRestricted),
+		errors.Is(err, services.ErrPromotionCodeFirstTimeTransaction):
+		return 400
+	case errors.Is(err, services.ErrTrialNotEligible):
+		return 403
+	case errors.Is(err, services.ErrCheckingSubscriptions),
+		errors.Is(err, services.ErrCheckingTrialEligibility):
+		return 500
+	default:
+		return 502
+	}
+}
+
+// returnURL returns where the user lands after a checkout: a path of the client application (/account when empty),
+// or a URL of an allowed origin. Its path must match the allowed path patterns. The placeholders are substituted,
+// status being success or cancel. The session ID is only known on success, cancel URLs holding its placeholder are refused.
+func returnURL(cfg *config.Config, value, status string) (string, error) {
+	if value == "" {
+		value = "/account"
+	}
+	value = strings.ReplaceAll(value, statusPlaceholder, status)
+	if status == returnStatusSuccess {
+		value = strings.ReplaceAll(value, sessionIdPlaceholder, services.CheckoutSessionIdPlaceholder)
+	} else if strings.Contains(value, sessionIdPlaceholder) || strings.Contains(value, services.CheckoutSessionIdPlaceholder) {
+		return "", ErrSessionIdInCancelURL
+	}
+	// Browsers read backslashes as slashes, "/\host" would redirect to another site
+	if strings.Contains(value, "\\") {
+		return "", ErrInvalidReturnPath
+	}
+
+	// Paths of the client application, "//host" would redirect to another site
+	if strings.HasPrefix(value, "/") && !strings.HasPrefix(value, "//") {
+		parsed, err := url.Parse(value)
+		if err != nil {
+			return "", ErrInvalidReturnPath
+		}
+		if !cleanReturnPath(parsed.Path) {
+			return "", ErrInvalidReturnPath
+		}
+		if !allowedReturnPath(cfg.Checkout.ReturnPaths, parsed.Path) {
+			return "", ErrReturnURLNotAllowed
+		}
+		return cfg.ClientURL + value, nil
+	}
+
+	parsed, err := url.Parse(value)
+	if err != nil || parsed.Scheme == "" || parsed.User != nil || !cleanReturnPath(parsed.Path) {
+		return "", ErrInvalidReturnPath
+	}
+	if !allowedReturnOrigin(cfg, parsed) || !allowedReturnPath(cfg.Checkout.ReturnPaths, parsed.Path) {
+		return "", ErrReturnURLNotAllowed
+	}
+	return value, nil
+}
+
+// allowedReturnOrigin tells whether a URL belongs to the client application or to one of the allowed origins
+func allowedReturnOrigin(cfg *config.Config, target *url.URL) bool {
+	origins := append([]string{cfg.ClientURL}, cfg.Checkout.ReturnOrigins...)
+	for _, origin := range origins {
+		allowed, err := url.Parse(origin)
+		if err != nil || origin == "" || !strings.EqualFold(allowed.Scheme, target.Scheme) {
+			continue
+		}
+		// Origins without host allow a whole mobile app scheme
+		if allowed.Host == "" || strings.EqualFold(allowed.Host, target.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanReturnPath tells whether a path has no dot segments nor empty segments, the patterns would match them
+// while browsers resolve them to another path, such as /checkout/../done for /checkout/*/done
+func cleanReturnPath(target string) bool {
+	if target == "" || target == "/" {
+		return true
+	}
+	cleaned := path.Clean(target)
+	return cleaned == target || cleaned+"/" == target
+}
+
+// allowedReturnPath tells whether a path matches one of the patterns, every path is allowed without patterns
+func allowedReturnPath(patterns []string, target string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	if target == "" {
+		target = "/"
+	}
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, target); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// withSessionId adds the session_id query param to a client URL, Stripe replaces its placeholder with the checkout session ID
+func withSessionId(clientURL string) string {
+	if strings.Contains(clientURL, services.CheckoutSessionIdPlaceholder) {
+		return clientURL
+	}
+	separator := "?"
+	if strings.Contains(clientURL, "?") {
+		separator = "&"
+	}
+	return clientURL + separator + "session_id=" + services.CheckoutSessionIdPlaceholder
+}
+
+// ListAbandonedCheckouts The `ListAbandonedCheckouts` function is a controller that lists the checkouts the user started and never finished,
+// with their recovery URL, so that the app can offer to finish the purchase.
+func ListAbandonedCheckouts() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := config.GetConfig()
+		userId := c.GetString("userId")
+		if userId == "" {
+			utils.SendResponse(c, false, 400, "userId is required", "Error listing abandoned checkouts", nil)
+			return
+		}
+		ctx := logger.With(c.Request.Context(), "userId", userId)
+
+		checkouts, err := cfg.Services.StripeService.ListAbandonedCheckouts(ctx, userId)
+		if err != nil {
+			utils.SendResponse(c, false, 500, err.Error(), "Error listing abandoned checkouts", nil)
+			return
+		}
+		utils.SendResponse(c, true, 200, "", "Abandoned checkouts retrieved successfully", checkouts)
+	}
+}
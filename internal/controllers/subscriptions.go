@@ -0,0 +1,261 @@
+package controllers
+
+import (
+	"errors"
+	"process-payments/internal/config"
+	"process-payments/internal/logger"
+	"process-payments/internal/models"
+	"process-payments/internal/services"
+	"process-payments/internal/utils"
+	"process-payments/pkg/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetEntitlement The `GetEntitlement` function is a controller that tells whether the user has access and through which subscriptions.
+func GetEntitlement() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := config.GetConfig()
+		userId := c.GetString("userId")
+		if userId == "" {
+			utils.SendResponse(c, false, 400, "userId is required", "Error getting entitlement", nil)
+			return
+		}
+		ctx := logger.With(c.Request.Context(), "userId", userId)
+
+		subscriptions, err := cfg.Collections.PaymentCollection.ListValidByUserId(ctx, userId)
+		if err != nil {
+			utils.SendResponse(c, false, 500, "Error getting entitlement", "Error getting entitlement", nil)
+			return
+		}
+
+		entitlements := make([]gin.H, 0, len(subscriptions))
+		for _, subscription := range subscriptions {
+			entitlements = append(entitlements, gin.H{
+				"subscriptionId": subscription.SubscriptionID,
+				"productId":      subscription.Plan.ProductId,
+				"priceId":        subscription.Plan.PriceId,
+				"status":         subscription.Status,
+				"isOneTime":      subscription.IsOneTime,
+				"isCanceled":     subscription.IsCanceled,
+				"isPaused":       subscription.Pause != nil,
+				"endsAt":         subscription.EndsAt,
+				"trialEndsAt":    subscription.TrialEndsAt,
+				"items":          subscription.Items,
+			})
+		}
+		utils.SendResponse(c, true, 200, "", "Entitlement retrieved successfully", gin.H{
+			"hasAccess":     len(subscriptions) > 0,
+			"subscriptions": entitlements,
+		})
+	}
+}
+
+// PreviewPlanChange The `PreviewPlanChange` function is a controller that previews the next invoice of a subscription after a plan change.
+func PreviewPlanChange() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := config.GetConfig()
+
+		change, ok := bindPlanChange(c, "Error previewing plan change")
+		if !ok {
+			return
+		}
+		ctx := logger.With(c.Request.Context(), "userId", change.UserId)
+
+		preview, err := cfg.Services.StripeService.PreviewPlanChange(ctx, change)
+		if err != nil {
+			utils.SendResponse(c, false, planChangeErrorStatus(err), err.Error(), "Error previewing plan change", nil)
+			return
+		}
+		utils.SendResponse(c, true, 200, "", "Plan change previewed successfully", preview)
+	}
+}
+
+// ChangePlan The `ChangePlan` function is a controller that switches a subscription to another price, now or at the end of the current period.
+func ChangePlan() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := config.GetConfig()
+
+		change, ok := bindPlanChange(c, "Error changing plan")
+		if !ok {
+			return
+		}
+		ctx := logger.With(c.Request.Context(), "userId", change.UserId)
+
+		subscription, err := cfg.Services.StripeService.ChangePlan(ctx, change)
+		if err != nil {
+			utils.SendResponse(c, false, planChangeErrorStatus(err), err.Error(), "Error changing plan", nil)
+			return
+		}
+		utils.SendResponse(c, true, 200, "", "Plan changed successfully", subscription)
+	}
+}
+
+// bindPlanChange reads the plan change of the request, answering 400 when it is not valid
+func bindPlanChange(c *gin.Context, message string) (services.PlanChange, bool) {
+	userId := c.GetString("userId")
+	if userId == "" {
+		utils.SendResponse(c, false, 400, "userId is required", message, nil)
+		return services.PlanChange{}, false
+	}
+
+	var body types.ChangePlanBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		utils.SendResponse(c, false, 400, err.Error(), message, nil)
+		return services.PlanChange{}, false
+	}
+
+	timing := services.PlanChangeTiming(body.Timing)
+	if timing == "" {
+		timing = services.PlanChangeNow
+	}
+	return services.PlanChange{
+		UserId:         userId,
+		SubscriptionId: c.Param("subscriptionId"),
+		ItemId:         body.ItemId,
+		ProductId:      body.ProductId,
+		PriceId:        body.PriceId,
+		Quantity:       body.Quantity,
+		Timing:         timing,
+	}, true
+}
+
+// planChangeErrorStatus maps the plan change errors to the HTTP status answered to the client
+func planChangeErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, services.ErrSubscriptionNotFound):
+		return 404
+	case errors.Is(err, services.ErrInvalidPlanChangeTiming),
+		errors.Is(err, services.ErrPriceNotRecurring),
+		errors.Is(err, services.ErrPriceNotInRegion),
+		errors.Is(err, services.ErrPlanChangeItemRequired),
+		errors.Is(err, services.ErrPlanChangeItemAmbiguous):
+		return 400
+	case errors.Is(err, services.ErrPlanChangeItemNotFound):
+		return 404
+	case errors.Is(err, services.ErrSamePlan):
+		return 409
+	default:
+		return 502
+	}
+}
+
+// CancelSubscription The `CancelSubscription` function is a controller that cancels a subscription at the end of its current period.
+// The optional JSON body holds the cancellation reason and feedback of the user.
+func CancelSubscription() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := config.GetConfig()
+		userId := c.GetString("userId")
+		if userId == "" {
+			utils.SendResponse(c, false, 400, "userId is required", "Error canceling subscription", nil)
+			return
+		}
+
+		var body types.CancelSubscriptionBody
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBindJSON(&body); err != nil {
+				utils.SendResponse(c, false, 400, err.Error(), "Error canceling subscription", nil)
+				return
+			}
+		}
+		ctx := logger.With(c.Request.Context(), "userId", userId)
+
+		subscription, err := cfg.Services.StripeService.CancelSubscription(ctx, userId, c.Param("subscriptionId"), models.CancellationInSubscription{
+			Reason:   body.Reason,
+			Feedback: body.Feedback,
+		})
+		if err != nil {
+			utils.SendResponse(c, false, subscriptionErrorStatus(err), err.Error(), "Error canceling subscription", nil)
+			return
+		}
+		utils.SendResponse(c, true, 200, "", "Subscription canceled successfully", subscription)
+	}
+}
+
+// ResumeSubscription The `ResumeSubscription` function is a controller that undoes the cancellation of a subscription before its period ends.
+func ResumeSubscription() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := config.GetConfig()
+		userId := c.GetString("userId")
+		if userId == "" {
+			utils.SendResponse(c, false, 400, "userId is required", "Error resuming subscription", nil)
+			return
+		}
+		ctx := logger.With(c.Request.Context(), "userId", userId)
+
+		subscription, err := cfg.Services.StripeService.ResumeSubscription(ctx, userId, c.Param("subscriptionId"))
+		if err != nil {
+			utils.SendResponse(c, false, subscriptionErrorStatus(err), err.Error(), "Error resuming subscription", nil)
+			return
+		}
+		utils.SendResponse(c, true, 200, "", "Subscription resumed successfully", subscription)
+	}
+}
+
+// PauseBilling The `PauseBilling` function is a controller that pauses the payment collection of a subscription.
+func PauseBilling() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := config.GetConfig()
+		userId := c.GetString("userId")
+		if userId == "" {
+			utils.SendResponse(c, false, 400, "userId is required", "Error pausing subscription billing", nil)
+			return
+		}
+
+		var body types.PauseBillingBody
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBindJSON(&body); err != nil {
+				utils.SendResponse(c, false, 400, err.Error(), "Error pausing subscription billing", nil)
+				return
+			}
+		}
+		if body.Behavior == "" {
+			body.Behavior = "void"
+		}
+		ctx := logger.With(c.Request.Context(), "userId", userId)
+
+		subscription, err := cfg.Services.StripeService.PauseBilling(ctx, userId, c.Param("subscriptionId"), body.Behavior, body.ResumesAt)
+		if err != nil {
+			utils.SendResponse(c, false, subscriptionErrorStatus(err), err.Error(), "Error pausing subscription billing", nil)
+			return
+		}
+		utils.SendResponse(c, true, 200, "", "Subscription billing paused successfully", subscription)
+	}
+}
+
+// ResumeBilling The `ResumeBilling` function is a controller that resumes the payment collection of a paused subscription.
+func ResumeBilling() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := config.GetConfig()
+		userId := c.GetString("userId")
+		if userId == "" {
+			utils.SendResponse(c, false, 400, "userId is required", "Error resuming subscription billing", nil)
+			return
+		}
+		ctx := logger.With(c.Request.Context(), "userId", userId)
+
+		subscription, err := cfg.Services.StripeService.ResumeBilling(ctx, userId, c.Param("subscriptionId"))
+		if err != nil {
+			utils.SendResponse(c, false, subscriptionErrorStatus(err), err.Error(), "Error resuming subscription billing", nil)
+			return
+		}
+		utils.SendResponse(c, true, 200, "", "Subscription billing resumed successfully", subscription)
+	}
+}
+
+// subscriptionErrorStatus maps the subscription management errors to the HTTP status answered to the client
+func subscriptionErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, services.ErrSubscriptionNotFound):
+		return 404
+	case errors.Is(err, services.ErrSubscriptionAlreadyCanceled),
+		errors.Is(err, services.ErrSubscriptionNotCanceled),
+		errors.Is(err, services.ErrSubscriptionAlreadyPaused),
+		errors.Is(err, services.ErrSubscriptionNotPaused):
+		return 409
+	case errors.Is(err, services.ErrInvalidResumeDate):
+		return 400
+	default:
+		return 502
+	}
+}
@@ -2,26 +2,78 @@ package database
 
 import (
 	"context"
-	"log"
+	"errors"
+	"log/slog"
 	"process-payments/internal/config"
 	"time"
 
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
-func DBInstance(cfg *config.Config) *mongo.Client {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// Connection retry settings
+const (
+	connectAttempts   = 8
+	connectTimeout    = 10 * time.Second
+	initialBackoff    = 500 * time.Millisecond
+	maxBackoff        = 30 * time.Second
+	pingCheckDeadline = 2 * time.Second
+)
+
+var ErrConnectingDatabase = errors.New("error connecting to database")
+
+// DBInstance connects to MongoDB and makes sure the server answers a ping.
+// Failed attempts are retried with an exponential backoff before giving up.
+func DBInstance(cfg *config.Config) (*mongo.Client, error) {
+	backoff := initialBackoff
+	var lastErr error
+	for attempt := 1; attempt <= connectAttempts; attempt++ {
+		client, err := connect(cfg.Mongo.URI)
+		if err == nil {
+			slog.Info("connected to MongoDB", "attempt", attempt)
+			return client, nil
+		}
+		lastErr = err
+
+		if attempt == connectAttempts {
+			break
+		}
+		slog.Warn("error connecting to MongoDB, retrying", "attempt", attempt, "retryIn", backoff, "error", err)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, maxBackoff)
+	}
+
+	return nil, errors.Join(ErrConnectingDatabase, lastErr)
+}
+
+func connect(uri string) (*mongo.Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
 	defer cancel()
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI(cfg.ENV.MONGO_URI).SetMaxPoolSize(100))
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri).SetMaxPoolSize(100))
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	log.Println("Connected to MongoDB!")
-	return client
+	// mongo.Connect doesn't reach the server, ping it to know it is actually up
+	if err := client.Ping(ctx, readpref.Primary()); err != nil {
+		_ = client.Disconnect(context.Background())
+		return nil, err
+	}
+	return client, nil
+}
+
+// Ping checks that the MongoDB primary answers in a short delay
+func Ping(ctx context.Context, client *mongo.Client) error {
+	if client == nil {
+		return ErrConnectingDatabase
+	}
+	ctx, cancel := context.WithTimeout(ctx, pingCheckDeadline)
+	defer cancel()
+	return client.Ping(ctx, readpref.Primary())
 }
 
-func OpenCollection(client *mongo.Client, collectionName string) *mongo.Collection {
-	return client.Database("processPayments").Collection(collectionName)
+func OpenCollection(client *mongo.Client, databaseName, collectionName string) *mongo.Collection {
+	return client.Database(databaseName).Collection(collectionName)
 }
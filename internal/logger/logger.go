@@ -0,0 +1,45 @@
+package logger
+
+import (
+	"context"
+	"log/slog"
+	"os"
+)
+
+type ctxKey struct{}
+
+// New builds the application logger. Production emits JSON lines, development a human-readable text format.
+func New(prod bool) *slog.Logger {
+	if prod {
+		return slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	}
+	return slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
+}
+
+// Init builds the application logger and installs it as the slog default.
+func Init(prod bool) *slog.Logger {
+	l := New(prod)
+	slog.SetDefault(l)
+	return l
+}
+
+// WithContext returns a copy of ctx carrying the given logger
+func WithContext(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, ctxKey{}, l)
+}
+
+// FromContext returns the logger carried by ctx, or the default logger when there is none
+func FromContext(ctx context.Context) *slog.Logger {
+	if ctx != nil {
+		if l, ok := ctx.Value(ctxKey{}).(*slog.Logger); ok {
+			return l
+		}
+	}
+	return slog.Default()
+}
+
+// With returns a copy of ctx whose logger has the given attributes attached.
+// Every line logged through FromContext on the returned context carries them.
+func With(ctx context.Context, args ...any) context.Context {
+	return WithContext(ctx, FromContext(ctx).With(args...))
+}
@@ -0,0 +1,122 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "process_payments"
+
+// Registry holds every collector exposed on the admin /metrics endpoint
+var Registry = prometheus.NewRegistry()
+
+// HTTP metrics
+var (
+	HTTPRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests handled, by method, route and status.",
+	}, []string{"method", "route", "status"})
+
+	HTTPRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of HTTP requests, by method, route and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+)
+
+// Webhook metrics
+var (
+	WebhookEventsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "stripe_webhook_events_total",
+		Help:      "Number of Stripe webhook events, by event type and outcome (received, processed, failed, ignored).",
+	}, []string{"type", "outcome"})
+)
+
+// Stripe API metrics
+var (
+	StripeAPIDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "stripe_api_call_duration_seconds",
+		Help:      "Latency of Stripe API calls, by operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	StripeAPIErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "stripe_api_call_errors_total",
+		Help:      "Number of failed Stripe API calls, by operation.",
+	}, []string{"operation"})
+
+	CheckoutSessionsCreatedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "checkout_sessions_created_total",
+		Help:      "Number of Stripe checkout sessions created, by product.",
+	}, []string{"product"})
+)
+
+// Rate limiting metrics
+var (
+	RateLimitRejectedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limit_rejected_total",
+		Help:      "Number of requests rejected by rate limiting, by route group and key type (user, ip).",
+	}, []string{"group", "key"})
+)
+
+// Repository metrics
+var (
+	RepositoryOperationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "repository_operation_duration_seconds",
+		Help:      "Latency of repository operations, by repository and operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"repository", "operation"})
+)
+
+// Webhook event outcomes
+const (
+	WebhookReceived  = "received"
+	WebhookProcessed = "processed"
+	WebhookFailed    = "failed"
+	WebhookIgnored   = "ignored"
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPRequestsTotal,
+		HTTPRequestDuration,
+		WebhookEventsTotal,
+		StripeAPIDuration,
+		StripeAPIErrorsTotal,
+		CheckoutSessionsCreatedTotal,
+		RateLimitRejectedTotal,
+		RepositoryOperationDuration,
+	)
+}
+
+// Handler serves the metrics of Registry in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+// ObserveStripeCall records the latency of a Stripe API call started at start, and counts it as failed when err is not nil
+func ObserveStripeCall(operation string, start time.Time, err error) {
+	StripeAPIDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		StripeAPIErrorsTotal.WithLabelValues(operation).Inc()
+	}
+}
+
+// ObserveRepositoryOperation records the latency of a repository operation started at start
+func ObserveRepositoryOperation(repository, operation string, start time.Time) {
+	RepositoryOperationDuration.WithLabelValues(repository, operation).Observe(time.Since(start).Seconds())
+}
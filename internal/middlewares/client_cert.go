@@ -0,0 +1,19 @@
+package middlewares
+
+import (
+	"process-payments/internal/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequireClientCert only lets through requests authenticated with a client certificate verified against the client CA
+func RequireClientCert() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.TLS == nil || len(c.Request.TLS.VerifiedChains) == 0 {
+			utils.SendResponse(c, false, 403, "client certificate required", "Forbidden", nil)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
@@ -7,10 +7,11 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-func CORSMiddleware(clientURL string, prod bool) gin.HandlerFunc {
+func CORSMiddleware(clientURL string, devOrigins []string, prod bool) gin.HandlerFunc {
 	config := cors.Config{
 		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Length", "Content-Type", "Authorization", "X-Authentication", "Stripe-Signature"},
+		AllowHeaders:     []string{"Origin", "Content-Length", "Content-Type", "Authorization", "X-Authentication", "Stripe-Signature", RequestIDHeader, IdempotencyKeyHeader},
+		ExposeHeaders:    []string{RequestIDHeader, "Idempotent-Replayed", "Retry-After"},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
 	}
@@ -18,7 +19,7 @@ func CORSMiddleware(clientURL string, prod bool) gin.HandlerFunc {
 	if prod {
 		config.AllowOrigins = []string{clientURL}
 	} else {
-		config.AllowOrigins = []string{"http://127.0.0.1:3000", "http://localhost:3000"}
+		config.AllowOrigins = devOrigins
 	}
 
 	return cors.New(config)
@@ -0,0 +1,146 @@
+package middlewares
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"process-payments/internal/logger"
+	"process-payments/internal/models"
+	"process-payments/internal/repository"
+	"process-payments/internal/utils"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// maxIdempotencyKeyLength leaves room for our prefix within Stripe's 255 characters idempotency keys
+const maxIdempotencyKeyLength = 128
+
+// maxIdempotentBodyBytes bounds the body buffered to be hashed, the JSON bodies of the idempotent routes are much smaller
+const maxIdempotentBodyBytes = 64 << 10
+
+// Idempotency makes requests sent with an Idempotency-Key header safe to retry: the first response is stored and
+// replayed for every later request with the same key and body. Requests without the header are handled normally.
+// The key is made available to the handlers under "idempotencyKey".
+func Idempotency(repo repository.IdempotencyRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(IdempotencyKeyHeader)
+		if key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			utils.SendResponse(c, false, 400, "Idempotency-Key is too long", "Invalid request", nil)
+			c.Abort()
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxIdempotentBodyBytes))
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			utils.SendResponse(c, false, 413, "request body is too large", "Invalid request", nil)
+			c.Abort()
+			return
+		}
+		if err != nil {
+			utils.SendResponse(c, false, 400, "error reading request body", "Invalid request", nil)
+			c.Abort()
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		ctx := c.Request.Context()
+		userId := c.GetString("userId")
+		// Keys are scoped to the route, a key can't replay the response of another endpoint.
+		// The hash covers the path params, such as the subscription ID, along with the body.
+		route := c.Request.Method + " " + c.FullPath()
+		hash := sha256.Sum256(append([]byte(c.Request.Method+" "+c.Request.URL.Path+"\n"), body...))
+		record := &models.IdempotencyRecord{
+			ID:          userId + ":" + route + ":" + key,
+			UserId:      userId,
+			Key:         key,
+			RequestHash: hex.EncodeToString(hash[:]),
+			Status:      models.IdempotencyProcessing,
+			CreatedAt:   time.Now(),
+		}
+
+		existing, err := repo.Begin(ctx, record)
+		if errors.Is(err, repository.ErrIdempotencyKeyExists) {
+			replay(c, record, existing)
+			return
+		}
+		if err != nil {
+			logger.FromContext(ctx).Error("error saving idempotency key", "error", err)
+			utils.SendResponse(c, false, 500, "error saving idempotency key", "Internal error", nil)
+			c.Abort()
+			return
+		}
+
+		c.Set("idempotencyKey", key)
+		recorder := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+
+		// The request outlives its context here, keep its values only
+		ctx = context.WithoutCancel(ctx)
+		handled := false
+		defer func() {
+			if handled {
+				return
+			}
+			// The handler panicked and the recovery middleware answers 500, let the client retry with the same key
+			if err := repo.Release(ctx, record.ID); err != nil {
+				logger.FromContext(ctx).Error("error releasing idempotency key", "error", err)
+			}
+		}()
+
+		c.Next()
+		handled = true
+
+		status := c.Writer.Status()
+		if status >= 500 {
+			// Server errors are not final, let the client retry with the same key
+			err = repo.Release(ctx, record.ID)
+		} else {
+			err = repo.Complete(ctx, record.ID, status, recorder.body.Bytes())
+		}
+		if err != nil {
+			logger.FromContext(ctx).Error("error saving idempotent response", "error", err)
+		}
+	}
+}
+
+// replay answers a request whose key was already used
+func replay(c *gin.Context, record, existing *models.IdempotencyRecord) {
+	switch {
+	case existing.RequestHash != record.RequestHash:
+		utils.SendResponse(c, false, 422, "Idempotency-Key was already used with a different request", "Invalid request", nil)
+	case existing.Status != models.IdempotencyCompleted:
+		utils.SendResponse(c, false, 409, "a request with this Idempotency-Key is still in progress", "Conflict", nil)
+	default:
+		c.Header("Idempotent-Replayed", "true")
+		c.Data(existing.ResponseStatus, "application/json; charset=utf-8", existing.ResponseBody)
+	}
+	c.Abort()
+}
+
+// responseRecorder keeps a copy of the response body
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	r.body.Write(data)
+	return r.ResponseWriter.Write(data)
+}
+
+func (r *responseRecorder) WriteString(s string) (int, error) {
+	r.body.WriteString(s)
+	return r.ResponseWriter.WriteString(s)
+}
@@ -1,9 +1,8 @@
 package middlewares
 
 import (
-	"fmt"
-	"log"
-	"os"
+	"log/slog"
+	"process-payments/internal/logger"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -18,24 +17,29 @@ func CustomLogger() gin.HandlerFunc {
 		c.Next()
 
 		// Stop timer
-		endTime := time.Now()
-		latency := endTime.Sub(startTime)
+		latency := time.Since(startTime)
 
 		// Collect request details
 		req := c.Request
 		status := c.Writer.Status()
-		clientIP := c.ClientIP()
-		method := req.Method
-		path := req.RequestURI
 
-		// Get user ID from context (assuming it's set elsewhere in your application)
-		userID := c.GetString("userId")
-
-		logLine := fmt.Sprintf("%s \"%s %s\" %d %s \"%s\" %s\n",
-			clientIP, method, path, status, latency, userID, c.Request.UserAgent())
-
-		logger := log.New(os.Stdout, "", log.Default().Flags())
-
-		logger.Println(logLine)
+		level := slog.LevelInfo
+		switch {
+		case status >= 500:
+			level = slog.LevelError
+		case status >= 400:
+			level = slog.LevelWarn
+		}
+
+		logger.FromContext(req.Context()).LogAttrs(req.Context(), level, "request",
+			slog.String("clientIp", c.ClientIP()),
+			slog.String("method", req.Method),
+			slog.String("path", req.RequestURI),
+			slog.Int("status", status),
+			slog.Duration("latency", latency),
+			// Get user ID from context (assuming it's set elsewhere in your application)
+			slog.String("userId", c.GetString("userId")),
+			slog.String("userAgent", req.UserAgent()),
+		)
 	}
 }
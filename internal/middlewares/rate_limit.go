@@ -0,0 +1,68 @@
+package middlewares
+
+import (
+	"math"
+	"process-payments/internal/logger"
+	"process-payments/internal/metrics"
+	"process-payments/internal/ratelimit"
+	"process-payments/internal/utils"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RateLimitPolicy holds the limits of a route group, keyed by user and by client IP
+type RateLimitPolicy struct {
+	PerUser ratelimit.Limit
+	PerIP   ratelimit.Limit
+}
+
+// RateLimiter applies the rate limit policies of the route groups
+type RateLimiter struct {
+	store    ratelimit.Store
+	policies map[string]RateLimitPolicy
+}
+
+func NewRateLimiter(store ratelimit.Store, policies map[string]RateLimitPolicy) *RateLimiter {
+	return &RateLimiter{store: store, policies: policies}
+}
+
+// Limit returns the middleware rate limiting the given route group. Groups without a policy are not limited.
+// It answers 429 with a Retry-After header when the client IP or the user ran out of tokens.
+func (l *RateLimiter) Limit(group string) gin.HandlerFunc {
+	policy, ok := l.policies[group]
+	if !ok || (!policy.PerIP.Enabled() && !policy.PerUser.Enabled()) {
+		return func(c *gin.Context) { c.Next() }
+	}
+
+	return func(c *gin.Context) {
+		if policy.PerIP.Enabled() && !l.take(c, group, "ip", c.ClientIP(), policy.PerIP) {
+			return
+		}
+		if userId := c.GetString("userId"); userId != "" && policy.PerUser.Enabled() && !l.take(c, group, "user", userId, policy.PerUser) {
+			return
+		}
+		c.Next()
+	}
+}
+
+// take takes a token for the key and aborts the request when none is left.
+// Store errors let the request through, an unavailable store must not take checkout down.
+func (l *RateLimiter) take(c *gin.Context, group, keyType, key string, limit ratelimit.Limit) bool {
+	ctx := c.Request.Context()
+	allowed, retryAfter, err := l.store.Take(ctx, group+":"+keyType+":"+key, limit)
+	if err != nil {
+		logger.FromContext(ctx).Error("error checking rate limit", "group", group, "keyType", keyType, "error", err)
+		return true
+	}
+	if allowed {
+		return true
+	}
+
+	metrics.RateLimitRejectedTotal.WithLabelValues(group, keyType).Inc()
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(max(retryAfter, time.Second).Seconds()))))
+	utils.SendResponse(c, false, 429, "rate limit exceeded", "Too many requests", nil)
+	c.Abort()
+	return false
+}
@@ -0,0 +1,120 @@
+package middlewares
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"process-payments/internal/ratelimit"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// failingStore is a rate limit store that is never available
+type failingStore struct{}
+
+func (failingStore) Take(context.Context, string, ratelimit.Limit) (bool, time.Duration, error) {
+	return false, 0, errors.New("store unavailable")
+}
+
+func newRateLimitedRouter(limiter *RateLimiter, group string) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		if userId := c.GetHeader("X-Test-User"); userId != "" {
+			c.Set("userId", userId)
+		}
+		c.Next()
+	})
+	router.GET("/", limiter.Limit(group), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	return router
+}
+
+func serve(router *gin.Engine, ip, userId string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = ip + ":1234"
+	if userId != "" {
+		req.Header.Set("X-Test-User", userId)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestRateLimiterPerIP(t *testing.T) {
+	limiter := NewRateLimiter(ratelimit.NewMemoryStore(), map[string]RateLimitPolicy{
+		"checkout": {PerIP: ratelimit.Every(1, time.Minute, 1)},
+	})
+	router := newRateLimitedRouter(limiter, "checkout")
+
+	if w := serve(router, "192.0.2.1", ""); w.Code != http.StatusOK {
+		t.Fatalf("first request status = %d, want %d", w.Code, http.StatusOK)
+	}
+	w := serve(router, "192.0.2.1", "")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("second request status = %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if got := w.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("Retry-After = %q, want %q", got, "60")
+	}
+	if w := serve(router, "192.0.2.2", ""); w.Code != http.StatusOK {
+		t.Errorf("other IP status = %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestRateLimiterPerUser(t *testing.T) {
+	limiter := NewRateLimiter(ratelimit.NewMemoryStore(), map[string]RateLimitPolicy{
+		"checkout": {PerUser: ratelimit.Every(2, time.Second, 1)},
+	})
+	router := newRateLimitedRouter(limiter, "checkout")
+
+	if w := serve(router, "192.0.2.1", "user-1"); w.Code != http.StatusOK {
+		t.Fatalf("first request status = %d, want %d", w.Code, http.StatusOK)
+	}
+	// The user is limited whatever the IP
+	w := serve(router, "192.0.2.2", "user-1")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("second request status = %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	// Retry-After is rounded up to a whole second
+	if got := w.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After = %q, want %q", got, "1")
+	}
+	if w := serve(router, "192.0.2.1", "user-2"); w.Code != http.StatusOK {
+		t.Errorf("other user status = %d, want %d", w.Code, http.StatusOK)
+	}
+	// Anonymous requests have no user bucket
+	for range 2 {
+		if w := serve(router, "192.0.2.1", ""); w.Code != http.StatusOK {
+			t.Errorf("anonymous request status = %d, want %d", w.Code, http.StatusOK)
+		}
+	}
+}
+
+func TestRateLimiterWithoutPolicy(t *testing.T) {
+	limiter := NewRateLimiter(ratelimit.NewMemoryStore(), map[string]RateLimitPolicy{
+		"checkout": {PerIP: ratelimit.Every(1, time.Minute, 1)},
+	})
+	router := newRateLimitedRouter(limiter, "portal")
+
+	for range 3 {
+		if w := serve(router, "192.0.2.1", ""); w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d for a group without a policy", w.Code, http.StatusOK)
+		}
+	}
+}
+
+func TestRateLimiterStoreError(t *testing.T) {
+	limiter := NewRateLimiter(failingStore{}, map[string]RateLimitPolicy{
+		"checkout": {PerIP: ratelimit.Every(1, time.Minute, 1), PerUser: ratelimit.Every(1, time.Minute, 1)},
+	})
+	router := newRateLimitedRouter(limiter, "checkout")
+
+	if w := serve(router, "192.0.2.1", "user-1"); w.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d when the store is unavailable", w.Code, http.StatusOK)
+	}
+}
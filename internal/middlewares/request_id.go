@@ -0,0 +1,57 @@
+package middlewares
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"process-payments/internal/logger"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds the size of a client supplied request ID
+const maxRequestIDLength = 128
+
+// RequestID honors the incoming X-Request-ID header (or generates a new ID), echoes it back in the response
+// and attaches it, with the trace ID when the request is traced, to the request logger.
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestId := c.GetHeader(RequestIDHeader)
+		if !isValidRequestID(requestId) {
+			requestId = newRequestID()
+		}
+
+		c.Set("requestId", requestId)
+		c.Header(RequestIDHeader, requestId)
+
+		ctx := logger.With(c.Request.Context(), "requestId", requestId)
+		// Correlate log lines with the request trace
+		if spanContext := trace.SpanContextFromContext(ctx); spanContext.IsValid() {
+			ctx = logger.With(ctx, "traceId", spanContext.TraceID().String())
+		}
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+	}
+}
+
+// isValidRequestID only accepts short printable ASCII IDs so clients can't inject into our logs
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,35 @@
+package models
+
+// Statuses of the recorded checkout sessions
+const (
+	CheckoutStatusOpen     = "open"
+	CheckoutStatusComplete = "complete"
+	// CheckoutStatusExpired is the status of the abandoned checkouts
+	CheckoutStatusExpired = "expired"
+	// CheckoutStatusRecovered is the status of an expired checkout completed through its recovery URL
+	CheckoutStatusRecovered = "recovered"
+)
+
+// CheckoutSession records a checkout session created for a user, to tell how many checkouts are abandoned
+type CheckoutSession struct {
+	SessionId string `bson:"_id" json:"sessionId"`
+	UserId    string `bson:"userId" json:"userId"`
+	// ProductId and PriceId are the main item of the cart
+	ProductId string `bson:"productId" json:"productId"`
+	PriceId   string `bson:"priceId" json:"priceId"`
+	// Mode is payment or subscription
+	Mode     string  `bson:"mode" json:"mode"`
+	Amount   float32 `bson:"amount" json:"amount"`
+	Currency string  `bson:"currency" json:"currency"`
+	Status   string  `bson:"status" json:"status"`
+	// RecoveryURL creates a copy of the session once it expired, set when checkout recovery is enabled
+	RecoveryURL       string `bson:"recoveryUrl,omitempty" json:"recoveryUrl,omitempty"`
+	RecoveryExpiresAt int64  `bson:"recoveryExpiresAt,omitempty" json:"recoveryExpiresAt,omitempty"`
+	// RecoveredBy is the session created from the recovery URL and completed
+	RecoveredBy string `bson:"recoveredBy,omitempty" json:"recoveredBy,omitempty"`
+	CreatedAt   int64  `bson:"createdAt" json:"createdAt"`
+	// ExpiresAt is when Stripe expires the session if it is not completed
+	ExpiresAt   int64 `bson:"expiresAt" json:"expiresAt"`
+	ExpiredAt   int64 `bson:"expiredAt,omitempty" json:"expiredAt,omitempty"`
+	CompletedAt int64 `bson:"completedAt,omitempty" json:"completedAt,omitempty"`
+}
@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+// Idempotency record statuses
+const (
+	IdempotencyProcessing = "processing"
+	IdempotencyCompleted  = "completed"
+)
+
+// IdempotencyRecord stores the response of a request made with an Idempotency-Key, to replay it on retries
+type IdempotencyRecord struct {
+	ID             string    `bson:"_id"`
+	UserId         string    `bson:"userId"`
+	Key            string    `bson:"key"`
+	RequestHash    string    `bson:"requestHash"`
+	Status         string    `bson:"status"`
+	ResponseStatus int       `bson:"responseStatus"`
+	ResponseBody   []byte    `bson:"responseBody"`
+	CreatedAt      time.Time `bson:"createdAt"`
+}
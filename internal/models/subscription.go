@@ -9,18 +9,30 @@ type Subscription struct {
 	SubscriptionID string             `bson:"subscriptionId"`
 	User           UserInSubscription `bson:"user"`
 	Plan           PlanInSubscription `bson:"plan"`
-	InvoiceLink    string             `bson:"invoiceLink"`
-	InvoicePDF     string             `bson:"invoicePDF"`
-	InvoiceNumber  string             `bson:"invoiceNumber"`
-	IsTest         bool               `bson:"isTest"`
-	IsOneTime      bool               `bson:"isOneTime"`
-	IsCanceled     bool               `bson:"isCanceled"`
-	UserId         string             `bson:"userId"`
-	Status         string             `bson:"status"`
-	EndsAt         int64              `bson:"endsAt"`
-	CreatedAt      int64              `bson:"createdAt"`
-	UpdatedAt      int64              `bson:"updatedAt"`
-	RenewsAt       int64              `bson:"renewsAt"`
+	// Items are every line bought with the checkout, the plan being the main one
+	Items         []ItemInSubscription `bson:"items,omitempty"`
+	InvoiceLink   string               `bson:"invoiceLink"`
+	InvoicePDF    string               `bson:"invoicePDF"`
+	InvoiceNumber string               `bson:"invoiceNumber"`
+	IsTest        bool                 `bson:"isTest"`
+	IsOneTime     bool                 `bson:"isOneTime"`
+	IsCanceled    bool                 `bson:"isCanceled"`
+	// Discount is the promotion code or coupon applied at checkout
+	Discount *DiscountInSubscription `bson:"discount,omitempty"`
+	// Tax is the tax of the last invoice and the tax IDs of the customer, set when Stripe Tax is enabled
+	Tax *TaxInSubscription `bson:"tax,omitempty"`
+	// Pause is set while the billing of the subscription is paused
+	Pause *PauseInSubscription `bson:"pause,omitempty"`
+	// Cancellation holds why the user canceled, while the subscription is canceled at period end
+	Cancellation *CancellationInSubscription `bson:"cancellation,omitempty"`
+	UserId       string                      `bson:"userId"`
+	Status       string                      `bson:"status"`
+	EndsAt       int64                       `bson:"endsAt"`
+	// TrialEndsAt is the end of the trial period, 0 when the subscription had no trial
+	TrialEndsAt int64 `bson:"trialEndsAt"`
+	CreatedAt   int64 `bson:"createdAt"`
+	UpdatedAt   int64 `bson:"updatedAt"`
+	RenewsAt    int64 `bson:"renewsAt"`
 }
 
 type UserInSubscription struct {
@@ -32,5 +44,77 @@ type UserInSubscription struct {
 type PlanInSubscription struct {
 	SessionId string  `bson:"sessionId"`
 	ProductId string  `bson:"productId"`
+	PriceId   string  `bson:"priceId"`
 	Price     float32 `bson:"price"`
+	// Interval and IntervalCount are the billing interval of the price, such as year and 1, empty for one-time purchases
+	Interval      string `bson:"interval,omitempty"`
+	IntervalCount int64  `bson:"intervalCount,omitempty"`
+	// ScheduledChange is the plan the subscription switches to at the end of the current period
+	ScheduledChange *ScheduledPlanChange `bson:"scheduledChange,omitempty"`
+}
+
+type ItemInSubscription struct {
+	ProductId string `bson:"productId"`
+	PriceId   string `bson:"priceId"`
+	Quantity  int64  `bson:"quantity"`
+	// Amount is the total of the line, after discounts for the items bought at checkout
+	Amount   float32 `bson:"amount"`
+	Currency string  `bson:"currency"`
+	// Recurring items are billed with the subscription, the others were paid once at checkout
+	Recurring bool `bson:"recurring"`
+}
+
+type DiscountInSubscription struct {
+	PromotionCodeId string  `bson:"promotionCodeId"`
+	Code            string  `bson:"code"`
+	CouponId        string  `bson:"couponId"`
+	PercentOff      float64 `bson:"percentOff"`
+	AmountOff       float32 `bson:"amountOff"`
+	Currency        string  `bson:"currency"`
+	// Duration is once, repeating or forever
+	Duration string `bson:"duration"`
+	// AmountDiscounted is the amount taken off the checkout
+	AmountDiscounted float32 `bson:"amountDiscounted"`
+}
+
+type TaxInSubscription struct {
+	Amount             float32 `bson:"amount"`
+	AmountExcludingTax float32 `bson:"amountExcludingTax"`
+	Currency           string  `bson:"currency"`
+	// Country is the billing address country the tax was calculated for
+	Country string `bson:"country"`
+	// TaxExempt is none, exempt or reverse, for reverse charged businesses
+	TaxExempt      string                `bson:"taxExempt"`
+	CustomerTaxIds []TaxIdInSubscription `bson:"customerTaxIds,omitempty"`
+}
+
+type TaxIdInSubscription struct {
+	// Type is the kind of tax ID, such as eu_vat
+	Type  string `bson:"type"`
+	Value string `bson:"value"`
+}
+
+type PauseInSubscription struct {
+	// Behavior is what Stripe does with the invoices while paused: void, keep_as_draft or mark_uncollectible
+	Behavior string `bson:"behavior"`
+	// ResumesAt is when billing resumes automatically, 0 when it is resumed by hand
+	ResumesAt int64 `bson:"resumesAt"`
+	PausedAt  int64 `bson:"pausedAt"`
+	// AccessEndsAt is the end of the period paid before the pause
+	AccessEndsAt int64 `bson:"accessEndsAt"`
+}
+
+type CancellationInSubscription struct {
+	// Reason is one of the Stripe cancellation feedbacks, such as too_expensive or unused
+	Reason string `bson:"reason"`
+	// Feedback is the free-text comment of the user
+	Feedback    string `bson:"feedback"`
+	RequestedAt int64  `bson:"requestedAt"`
+}
+
+type ScheduledPlanChange struct {
+	ScheduleId  string `bson:"scheduleId"`
+	ProductId   string `bson:"productId"`
+	PriceId     string `bson:"priceId"`
+	EffectiveAt int64  `bson:"effectiveAt"`
 }
@@ -0,0 +1,34 @@
+package models
+
+import "time"
+
+// Trial identity kinds, a trial is refused when any identity of the user already had one
+const (
+	TrialIdentityUser            = "user"
+	TrialIdentityCustomer        = "customer"
+	TrialIdentityEmail           = "email"
+	TrialIdentityCardFingerprint = "cardFingerprint"
+)
+
+// TrialIdentity is something that identifies who used a trial
+type TrialIdentity struct {
+	Kind  string
+	Value string
+}
+
+// TrialUsage records that an identity used a trial. The ID is a hash of the identity, the value itself is not stored.
+type TrialUsage struct {
+	ID             string    `bson:"_id"`
+	Kind           string    `bson:"kind"`
+	UserId         string    `bson:"userId"`
+	SubscriptionId string    `bson:"subscriptionId"`
+	CreatedAt      time.Time `bson:"createdAt"`
+}
+
+// TrialOverride is an admin decision on the trial eligibility of a user, it wins over the recorded usages
+type TrialOverride struct {
+	UserId    string    `bson:"_id" json:"userId"`
+	Eligible  bool      `bson:"eligible" json:"eligible"`
+	Reason    string    `bson:"reason" json:"reason"`
+	CreatedAt time.Time `bson:"createdAt" json:"createdAt"`
+}
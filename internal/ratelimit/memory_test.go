@@ -0,0 +1,128 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock moved forward by the tests
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func newTestMemoryStore() (*MemoryStore, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	store := NewMemoryStore()
+	store.now = clock.Now
+	store.lastSweep = clock.now
+	return store, clock
+}
+
+func take(t *testing.T, store Store, key string, limit Limit) (bool, time.Duration) {
+	t.Helper()
+	allowed, retryAfter, err := store.Take(context.Background(), key, limit)
+	if err != nil {
+		t.Fatalf("Take(%q) error = %v", key, err)
+	}
+	return allowed, retryAfter
+}
+
+func TestMemoryStoreBurstCap(t *testing.T) {
+	store, _ := newTestMemoryStore()
+	limit := Every(1, time.Second, 3)
+
+	for i := range 3 {
+		if allowed, _ := take(t, store, "key", limit); !allowed {
+			t.Fatalf("request %d rejected within the burst", i+1)
+		}
+	}
+	allowed, retryAfter := take(t, store, "key", limit)
+	if allowed {
+		t.Fatal("request allowed past the burst")
+	}
+	if retryAfter != time.Second {
+		t.Errorf("retryAfter = %v, want %v", retryAfter, time.Second)
+	}
+}
+
+func TestMemoryStoreRefill(t *testing.T) {
+	store, clock := newTestMemoryStore()
+	limit := Every(2, time.Second, 2)
+
+	take(t, store, "key", limit)
+	take(t, store, "key", limit)
+	if allowed, retryAfter := take(t, store, "key", limit); allowed || retryAfter != 500*time.Millisecond {
+		t.Fatalf("empty bucket: allowed = %v, retryAfter = %v, want false, 500ms", allowed, retryAfter)
+	}
+
+	clock.Advance(250 * time.Millisecond)
+	if allowed, retryAfter := take(t, store, "key", limit); allowed || retryAfter != 250*time.Millisecond {
+		t.Fatalf("half a token: allowed = %v, retryAfter = %v, want false, 250ms", allowed, retryAfter)
+	}
+
+	clock.Advance(250 * time.Millisecond)
+	if allowed, _ := take(t, store, "key", limit); !allowed {
+		t.Fatal("request rejected after a token was refilled")
+	}
+	if allowed, _ := take(t, store, "key", limit); allowed {
+		t.Fatal("request allowed past the refilled token")
+	}
+}
+
+func TestMemoryStoreRefillCappedAtBurst(t *testing.T) {
+	store, clock := newTestMemoryStore()
+	limit := Every(1, time.Second, 2)
+
+	take(t, store, "key", limit)
+	take(t, store, "key", limit)
+	clock.Advance(time.Minute)
+
+	for i := range 2 {
+		if allowed, _ := take(t, store, "key", limit); !allowed {
+			t.Fatalf("request %d rejected after the bucket was refilled", i+1)
+		}
+	}
+	if allowed, _ := take(t, store, "key", limit); allowed {
+		t.Fatal("bucket refilled past the burst")
+	}
+}
+
+func TestMemoryStoreSeparateKeys(t *testing.T) {
+	store, _ := newTestMemoryStore()
+	limit := Every(1, time.Minute, 1)
+
+	if allowed, _ := take(t, store, "a", limit); !allowed {
+		t.Fatal("first request of a rejected")
+	}
+	if allowed, _ := take(t, store, "a", limit); allowed {
+		t.Fatal("second request of a allowed")
+	}
+	if allowed, _ := take(t, store, "b", limit); !allowed {
+		t.Fatal("first request of b rejected by the bucket of a")
+	}
+}
+
+func TestMemoryStoreSweep(t *testing.T) {
+	store, clock := newTestMemoryStore()
+	limit := Every(1, time.Hour, 1)
+
+	take(t, store, "idle", limit)
+	clock.Advance(idleBucketTTL + time.Second)
+	take(t, store, "active", limit)
+
+	if _, ok := store.buckets["idle"]; ok {
+		t.Error("idle bucket not swept")
+	}
+	if _, ok := store.buckets["active"]; !ok {
+		t.Error("active bucket swept")
+	}
+}
@@ -0,0 +1,76 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoStore keeps the token buckets in a MongoDB collection shared by every replica
+type MongoStore struct {
+	collection *mongo.Collection
+	// now is the clock of the store, replaced by tests
+	now func() time.Time
+}
+
+type mongoBucket struct {
+	Tokens  float64 `bson:"tokens"`
+	Allowed bool    `bson:"allowed"`
+}
+
+// NewMongoStore creates the store and the TTL index dropping idle buckets
+func NewMongoStore(ctx context.Context, collection *mongo.Collection) (*MongoStore, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "updatedAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(int32(idleBucketTTL.Seconds())),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &MongoStore{collection: collection, now: time.Now}, nil
+}
+
+// Take refills and takes from the bucket in a single atomic update, so concurrent replicas never overdraw it
+func (s *MongoStore) Take(ctx context.Context, key string, limit Limit) (bool, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	// Mongo dates have a millisecond precision
+	now := s.now().Truncate(time.Millisecond)
+	burst := float64(limit.Burst)
+	elapsedSeconds := bson.M{"$divide": bson.A{
+		bson.M{"$subtract": bson.A{now, bson.M{"$ifNull": bson.A{"$updatedAt", now}}}},
+		1000,
+	}}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"tokens": bson.M{"$min": bson.A{burst, bson.M{"$add": bson.A{
+				bson.M{"$ifNull": bson.A{"$tokens", burst}},
+				bson.M{"$multiply": bson.A{elapsedSeconds, limit.Rate}},
+			}}}},
+			"updatedAt": now,
+		}}},
+		{{Key: "$set", Value: bson.M{"allowed": bson.M{"$gte": bson.A{"$tokens", 1}}}}},
+		{{Key: "$set", Value: bson.M{"tokens": bson.M{"$cond": bson.A{"$allowed", bson.M{"$subtract": bson.A{"$tokens", 1}}, "$tokens"}}}}},
+	}
+
+	var result mongoBucket
+	err := s.collection.FindOneAndUpdate(ctx, bson.M{"_id": key}, pipeline,
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&result)
+	if err != nil {
+		return false, 0, err
+	}
+
+	if !result.Allowed {
+		return false, limit.retryAfter(result.Tokens), nil
+	}
+	return true, 0, nil
+}
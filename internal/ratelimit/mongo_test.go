@@ -0,0 +1,78 @@
+package ratelimit
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// newTestMongoStore connects to the database of MONGO_TEST_URI, the tests are skipped without it
+func newTestMongoStore(t *testing.T) (*MongoStore, *fakeClock) {
+	t.Helper()
+	uri := os.Getenv("MONGO_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGO_TEST_URI is not set")
+	}
+
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatalf("connecting to MongoDB: %v", err)
+	}
+	collection := client.Database("ratelimit_test").Collection(t.Name())
+	t.Cleanup(func() {
+		_ = collection.Drop(ctx)
+		_ = client.Disconnect(ctx)
+	})
+
+	store, err := NewMongoStore(ctx, collection)
+	if err != nil {
+		t.Fatalf("NewMongoStore error = %v", err)
+	}
+	clock := &fakeClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	store.now = clock.Now
+	return store, clock
+}
+
+func TestMongoStoreBurstAndRefill(t *testing.T) {
+	store, clock := newTestMongoStore(t)
+	limit := Every(2, time.Second, 2)
+
+	take(t, store, "key", limit)
+	take(t, store, "key", limit)
+	if allowed, retryAfter := take(t, store, "key", limit); allowed || retryAfter != 500*time.Millisecond {
+		t.Fatalf("empty bucket: allowed = %v, retryAfter = %v, want false, 500ms", allowed, retryAfter)
+	}
+
+	clock.Advance(500 * time.Millisecond)
+	if allowed, _ := take(t, store, "key", limit); !allowed {
+		t.Fatal("request rejected after a token was refilled")
+	}
+
+	clock.Advance(time.Minute)
+	for i := range 2 {
+		if allowed, _ := take(t, store, "key", limit); !allowed {
+			t.Fatalf("request %d rejected after the bucket was refilled", i+1)
+		}
+	}
+	if allowed, _ := take(t, store, "key", limit); allowed {
+		t.Fatal("bucket refilled past the burst")
+	}
+}
+
+func TestMongoStoreSeparateKeys(t *testing.T) {
+	store, _ := newTestMongoStore(t)
+	limit := Every(1, time.Minute, 1)
+
+	take(t, store, "a", limit)
+	if allowed, _ := take(t, store, "a", limit); allowed {
+		t.Fatal("second request of a allowed")
+	}
+	if allowed, _ := take(t, store, "b", limit); !allowed {
+		t.Fatal("first request of b rejected by the bucket of a")
+	}
+}
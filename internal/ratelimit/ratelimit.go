@@ -0,0 +1,48 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// Stores
+const (
+	StoreMemory = "memory"
+	StoreMongo  = "mongo"
+)
+
+// Limit describes a token bucket: it is refilled at Rate tokens per second and holds up to Burst tokens
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Every returns the limit allowing count requests per period, with bursts of up to burst requests
+func Every(count int, period time.Duration, burst int) Limit {
+	if count <= 0 || period <= 0 {
+		return Limit{}
+	}
+	return Limit{Rate: float64(count) / period.Seconds(), Burst: burst}
+}
+
+// Enabled reports whether the limit restricts anything
+func (l Limit) Enabled() bool {
+	return l.Rate > 0 && l.Burst > 0
+}
+
+// retryAfter returns the delay until the bucket holds a whole token again
+func (l Limit) retryAfter(tokens float64) time.Duration {
+	missing := 1 - tokens
+	if missing <= 0 {
+		return 0
+	}
+	return time.Duration(math.Ceil(missing / l.Rate * float64(time.Second)))
+}
+
+// Store keeps the token buckets
+type Store interface {
+	// Take removes a token from the bucket of key. It reports whether the request is allowed and,
+	// when it isn't, how long to wait for a token to be available.
+	Take(ctx context.Context, key string, limit Limit) (bool, time.Duration, error)
+}
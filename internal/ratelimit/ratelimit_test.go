@@ -0,0 +1,53 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEvery(t *testing.T) {
+	tests := []struct {
+		name    string
+		count   int
+		period  time.Duration
+		burst   int
+		want    Limit
+		enabled bool
+	}{
+		{name: "per minute", count: 30, period: time.Minute, burst: 5, want: Limit{Rate: 0.5, Burst: 5}, enabled: true},
+		{name: "per second", count: 10, period: time.Second, burst: 10, want: Limit{Rate: 10, Burst: 10}, enabled: true},
+		{name: "no count", count: 0, period: time.Minute, burst: 5, want: Limit{}},
+		{name: "no period", count: 30, period: 0, burst: 5, want: Limit{}},
+		{name: "no burst", count: 30, period: time.Minute, burst: 0, want: Limit{Rate: 0.5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Every(tt.count, tt.period, tt.burst)
+			if got != tt.want {
+				t.Errorf("Every(%d, %v, %d) = %+v, want %+v", tt.count, tt.period, tt.burst, got, tt.want)
+			}
+			if got.Enabled() != tt.enabled {
+				t.Errorf("Enabled() = %v, want %v", got.Enabled(), tt.enabled)
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	limit := Every(30, time.Minute, 5)
+	tests := []struct {
+		tokens float64
+		want   time.Duration
+	}{
+		{tokens: 0, want: 2 * time.Second},
+		{tokens: 0.5, want: time.Second},
+		{tokens: 0.75, want: 500 * time.Millisecond},
+		{tokens: 1, want: 0},
+		{tokens: 3, want: 0},
+	}
+	for _, tt := range tests {
+		if got := limit.retryAfter(tt.tokens); got != tt.want {
+			t.Errorf("retryAfter(%v) = %v, want %v", tt.tokens, got, tt.want)
+		}
+	}
+}
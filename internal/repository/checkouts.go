@@ -0,0 +1,146 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"process-payments/internal/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AbandonedCheckoutsLimit is the number of abandoned checkouts listed per user, the latest first
+const AbandonedCheckoutsLimit = 20
+
+type CheckoutRepository interface {
+	// Save creates or replaces the record of a checkout session
+	Save(ctx context.Context, checkout *models.CheckoutSession) error
+	// Complete marks a checkout session as completed, ErrCheckoutNotFound when it was not recorded
+	Complete(ctx context.Context, sessionId string, completedAt int64) error
+	// Expire marks a checkout session as abandoned with its recovery URL, ErrCheckoutNotFound when it was not recorded
+	Expire(ctx context.Context, sessionId string, expiredAt int64, recoveryURL string, recoveryExpiresAt int64) error
+	// Recover marks an expired checkout session as completed through the session created from its recovery URL
+	Recover(ctx context.Context, sessionId, recoveredBy string) error
+	// ListAbandonedByUserId returns the expired checkout sessions of a user, the latest first
+	ListAbandonedByUserId(ctx context.Context, userId string) ([]*models.CheckoutSession, error)
+}
+
+type MongoCheckoutRepository struct {
+	collection *mongo.Collection
+}
+
+// Errors
+var (
+	ErrCheckoutNotFound  = errors.New("checkout session not found")
+	ErrorSavingCheckout  = errors.New("error saving checkout session")
+	ErrorListingCheckout = errors.New("error listing checkout sessions")
+)
+
+// NewMongoCheckoutRepository creates the repository and the index listing the checkouts of a user by status
+func NewMongoCheckoutRepository(ctx context.Context, collection *mongo.Collection) (CheckoutRepository, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "userId", Value: 1}, {Key: "status", Value: 1}, {Key: "expiredAt", Value: -1}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &MongoCheckoutRepository{collection: collection}, nil
+}
+
+func (r *MongoCheckoutRepository) startOperation(ctx context.Context, operation string) (context.Context, func(error)) {
+	return startOperation(ctx, "checkouts", r.collection.Name(), operation)
+}
+
+// Save upserts the checkout session under its ID
+func (r *MongoCheckoutRepository) Save(ctx context.Context, checkout *models.CheckoutSession) (err error) {
+	ctx, end := r.startOperation(ctx, "Save")
+	defer func() { end(err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err = r.collection.ReplaceOne(ctx, bson.M{"_id": checkout.SessionId}, checkout, options.Replace().SetUpsert(true))
+	if err != nil {
+		return ErrorSavingCheckout
+	}
+	return nil
+}
+
+// Complete sets the completed status of a session
+func (r *MongoCheckoutRepository) Complete(ctx context.Context, sessionId string, completedAt int64) (err error) {
+	ctx, end := r.startOperation(ctx, "Complete")
+	defer func() { end(err) }()
+
+	return r.update(ctx, bson.M{"_id": sessionId}, bson.M{
+		"status":      models.CheckoutStatusComplete,
+		"completedAt": completedAt,
+	})
+}
+
+// Expire sets the expired status of a session and its recovery URL
+func (r *MongoCheckoutRepository) Expire(ctx context.Context, sessionId string, expiredAt int64, recoveryURL string, recoveryExpiresAt int64) (err error) {
+	ctx, end := r.startOperation(ctx, "Expire")
+	defer func() { end(err) }()
+
+	return r.update(ctx, bson.M{"_id": sessionId}, bson.M{
+		"status":            models.CheckoutStatusExpired,
+		"expiredAt":         expiredAt,
+		"recoveryUrl":       recoveryURL,
+		"recoveryExpiresAt": recoveryExpiresAt,
+	})
+}
+
+// Recover sets the recovered status of an expired session
+func (r *MongoCheckoutRepository) Recover(ctx context.Context, sessionId, recoveredBy string) (err error) {
+	ctx, end := r.startOperation(ctx, "Recover")
+	defer func() { end(err) }()
+
+	return r.update(ctx, bson.M{"_id": sessionId}, bson.M{
+		"status":      models.CheckoutStatusRecovered,
+		"recoveredBy": recoveredBy,
+	})
+}
+
+// update sets fields of the session matching filter
+func (r *MongoCheckoutRepository) update(ctx context.Context, filter bson.M, fields bson.M) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	result, err := r.collection.UpdateOne(ctx, filter, bson.M{"$set": fields})
+	if err != nil {
+		return ErrorSavingCheckout
+	}
+	if result.MatchedCount == 0 {
+		return ErrCheckoutNotFound
+	}
+	return nil
+}
+
+// ListAbandonedByUserId returns the last AbandonedCheckoutsLimit expired sessions of a user
+func (r *MongoCheckoutRepository) ListAbandonedByUserId(ctx context.Context, userId string) (_ []*models.CheckoutSession, err error) {
+	ctx, end := r.startOperation(ctx, "ListAbandonedByUserId")
+	defer func() { end(err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	cursor, err := r.collection.Find(ctx,
+		bson.M{"userId": userId, "status": models.CheckoutStatusExpired},
+		options.Find().SetSort(bson.M{"expiredAt": -1}).SetLimit(AbandonedCheckoutsLimit),
+	)
+	if err != nil {
+		return nil, ErrorListingCheckout
+	}
+
+	checkouts := make([]*models.CheckoutSession, 0)
+	err = cursor.All(ctx, &checkouts)
+	if err != nil {
+		return nil, ErrorListingCheckout
+	}
+	return checkouts, nil
+}
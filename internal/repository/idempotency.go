@@ -0,0 +1,112 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"process-payments/internal/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// IdempotencyKeyTTL is how long a response is kept for replay
+const IdempotencyKeyTTL = 24 * time.Hour
+
+type IdempotencyRepository interface {
+	// Begin reserves the record ID for a new request. When the ID is already taken, the existing record is returned
+	// along with ErrIdempotencyKeyExists.
+	Begin(ctx context.Context, record *models.IdempotencyRecord) (*models.IdempotencyRecord, error)
+	// Complete stores the response of the request
+	Complete(ctx context.Context, id string, status int, body []byte) error
+	// Release forgets the record so the request can be retried
+	Release(ctx context.Context, id string) error
+}
+
+type MongoIdempotencyRepository struct {
+	collection *mongo.Collection
+}
+
+// Errors
+var (
+	ErrIdempotencyKeyExists = errors.New("idempotency key already used")
+	ErrorSavingIdempotency  = errors.New("error saving idempotency record")
+)
+
+// NewMongoIdempotencyRepository creates the repository and the TTL index dropping expired records
+func NewMongoIdempotencyRepository(ctx context.Context, collection *mongo.Collection) (IdempotencyRepository, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "createdAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(int32(IdempotencyKeyTTL.Seconds())),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &MongoIdempotencyRepository{collection: collection}, nil
+}
+
+func (r *MongoIdempotencyRepository) startOperation(ctx context.Context, operation string) (context.Context, func(error)) {
+	return startOperation(ctx, "idempotency", r.collection.Name(), operation)
+}
+
+// Begin inserts the record, the unique _id makes concurrent requests with the same key race safely
+func (r *MongoIdempotencyRepository) Begin(ctx context.Context, record *models.IdempotencyRecord) (_ *models.IdempotencyRecord, err error) {
+	ctx, end := r.startOperation(ctx, "Begin")
+	defer func() { end(err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err = r.collection.InsertOne(ctx, record)
+	if err == nil {
+		return record, nil
+	}
+	if !mongo.IsDuplicateKeyError(err) {
+		return nil, ErrorSavingIdempotency
+	}
+
+	var existing models.IdempotencyRecord
+	err = r.collection.FindOne(ctx, bson.M{"_id": record.ID}).Decode(&existing)
+	if err != nil {
+		return nil, ErrorSavingIdempotency
+	}
+	return &existing, ErrIdempotencyKeyExists
+}
+
+// Complete stores the response of the request
+func (r *MongoIdempotencyRepository) Complete(ctx context.Context, id string, status int, body []byte) (err error) {
+	ctx, end := r.startOperation(ctx, "Complete")
+	defer func() { end(err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err = r.collection.UpdateByID(ctx, id, bson.M{"$set": bson.M{
+		"status":         models.IdempotencyCompleted,
+		"responseStatus": status,
+		"responseBody":   body,
+	}})
+	if err != nil {
+		return ErrorSavingIdempotency
+	}
+	return nil
+}
+
+// Release deletes the record
+func (r *MongoIdempotencyRepository) Release(ctx context.Context, id string) (err error) {
+	ctx, end := r.startOperation(ctx, "Release")
+	defer func() { end(err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err = r.collection.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return ErrorSavingIdempotency
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"process-payments/internal/metrics"
+	"process-payments/internal/tracing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// startOperation starts a span for a repository operation.
+// The returned function ends the span and records the operation latency.
+func startOperation(ctx context.Context, repository, collection, operation string) (context.Context, func(error)) {
+	start := time.Now()
+	ctx, span := tracing.Start(ctx, repository+"."+operation,
+		attribute.String("db.system", "mongodb"),
+		attribute.String("db.collection.name", collection),
+		attribute.String("db.operation.name", operation),
+	)
+	return ctx, func(err error) {
+		metrics.ObserveRepositoryOperation(repository, operation, start)
+		// Missing or already existing documents are expected outcomes, not failed operations
+		if errors.Is(err, ErrSubscriptionNotFound) || errors.Is(err, ErrSubscriptionAlreadyExists) || errors.Is(err, ErrIdempotencyKeyExists) ||
+			errors.Is(err, ErrTrialUsageNotFound) || errors.Is(err, ErrTrialOverrideNotFound) {
+			err = nil
+		}
+		tracing.End(span, err)
+	}
+}
@@ -1,30 +1,66 @@
 package repository
 
 import (
+	"cmp"
 	"context"
 	"errors"
-	"log"
+	"process-payments/internal/logger"
 	"process-payments/internal/models"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type PaymentRepository interface {
-	Save(subs *models.Subscription) error
-	GetByUserId(userId string) (*models.Subscription, error)
-	Get(subscriptionId string) (*models.Subscription, error)
-	Update(subscription *models.Subscription) error
-	Delete(subscriptionId string) error
+	Save(ctx context.Context, subs *models.Subscription) error
+	GetByUserId(ctx context.Context, userId string) (*models.Subscription, error)
+	Get(ctx context.Context, subscriptionId string) (*models.Subscription, error)
+	Update(ctx context.Context, subscription *models.Subscription) error
+	Delete(ctx context.Context, subscriptionId string) error
+	// ListValidByUserId returns the subscriptions of a user that currently grant access
+	ListValidByUserId(ctx context.Context, userId string) ([]*models.Subscription, error)
 	// IsValid checks if a subscription is valid for a given user ID
-	IsValid(userId string) bool
+	IsValid(ctx context.Context, userId string) bool
 }
 
 type MongoPaymentRepository struct {
-	collection *mongo.Collection
+	collection    *mongo.Collection
+	pausedAccess  PausedAccess
+	pendingAccess PendingAccess
 }
 
+// PausedAccess tells whether a subscription with paused billing grants access
+type PausedAccess string
+
+const (
+	// PausedAccessDeny grants no access while billing is paused
+	PausedAccessDeny PausedAccess = "deny"
+	// PausedAccessPaidPeriod grants access until the end of the period paid before the pause
+	PausedAccessPaidPeriod PausedAccess = "paid_period"
+	// PausedAccessAllow grants access as long as the subscription is active, even without payments
+	PausedAccessAllow PausedAccess = "allow"
+)
+
+// PendingAccess tells whether a purchase waiting for a delayed payment, such as a SEPA Debit, grants access
+type PendingAccess string
+
+const (
+	// PendingAccessDeny grants access once the payment succeeded
+	PendingAccessDeny PendingAccess = "deny"
+	// PendingAccessAllow grants access while the payment is pending, it is withdrawn if the payment fails
+	PendingAccessAllow PendingAccess = "allow"
+)
+
+// Statuses of the purchases paid with delayed notification payment methods, besides the Stripe statuses
+const (
+	// StatusPendingPayment is the status of a completed checkout whose payment is not confirmed yet
+	StatusPendingPayment = "pending_payment"
+	// StatusPaymentFailed is the status of a checkout whose delayed payment failed
+	StatusPaymentFailed = "payment_failed"
+)
+
 // Errors
 var (
 	ErrSubscriptionAlreadyExists = errors.New("subscription already exists")
@@ -33,22 +69,72 @@ var (
 	ErrorDeletingSubscription    = errors.New("error deleting subscription")
 )
 
-func NewMongoPaymentRepository(collection *mongo.Collection) PaymentRepository {
-	return &MongoPaymentRepository{collection: collection}
+// NewMongoPaymentRepository creates the repository and the unique index on the subscription ID,
+// so that a checkout fulfilled by the webhook and by the user coming back at the same time is only saved once.
+// Subscriptions saved twice before the index existed prevent its creation: they are logged and the service starts
+// without the index, it is created on the next start once they are cleaned up.
+func NewMongoPaymentRepository(ctx context.Context, collection *mongo.Collection, pausedAccess PausedAccess, pendingAccess PendingAccess) (PaymentRepository, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "subscriptionId", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		duplicates, findErr := duplicateSubscriptionIds(ctx, collection)
+		logger.FromContext(ctx).Error("subscriptions saved more than once, the unique subscriptionId index is not created until they are cleaned up",
+			"subscriptionIds", duplicates, "error", cmp.Or(findErr, err))
+	} else if err != nil {
+		return nil, err
+	}
+	return &MongoPaymentRepository{collection: collection, pausedAccess: pausedAccess, pendingAccess: pendingAccess}, nil
+}
+
+// duplicateSubscriptionIds returns the subscription IDs saved in more than one document
+func duplicateSubscriptionIds(ctx context.Context, collection *mongo.Collection) ([]string, error) {
+	cursor, err := collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{"_id": "$subscriptionId", "count": bson.M{"$sum": 1}}}},
+		{{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 1}}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var groups []struct {
+		SubscriptionId string `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+	subscriptionIds := make([]string, 0, len(groups))
+	for _, group := range groups {
+		subscriptionIds = append(subscriptionIds, group.SubscriptionId)
+	}
+	return subscriptionIds, nil
+}
+
+func (r *MongoPaymentRepository) startOperation(ctx context.Context, operation string) (context.Context, func(error)) {
+	return startOperation(ctx, "payments", r.collection.Name(), operation)
 }
 
 // Save a subscription object into the database
-func (r *MongoPaymentRepository) Save(subs *models.Subscription) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func (r *MongoPaymentRepository) Save(ctx context.Context, subs *models.Subscription) (err error) {
+	ctx, end := r.startOperation(ctx, "Save")
+	defer func() { end(err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
 	//check if userId has already a subscription object
-	_, err := r.Get(subs.SubscriptionID)
+	_, err = r.Get(ctx, subs.SubscriptionID)
 	if err == nil {
 		return ErrSubscriptionAlreadyExists
 	}
 
 	_, err = r.collection.InsertOne(ctx, subs)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrSubscriptionAlreadyExists
+	}
 	if err != nil {
 		return err
 	}
@@ -56,20 +142,23 @@ func (r *MongoPaymentRepository) Save(subs *models.Subscription) error {
 }
 
 // Get a subscription by subscriptionId
-func (r *MongoPaymentRepository) Get(subscriptionId string) (*models.Subscription, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func (r *MongoPaymentRepository) Get(ctx context.Context, subscriptionId string) (_ *models.Subscription, err error) {
+	ctx, end := r.startOperation(ctx, "Get")
+	defer func() { end(err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
 	var subscription models.Subscription
 
 	filter := bson.M{"subscriptionId": subscriptionId}
 
-	err := r.collection.FindOne(ctx, filter).Decode(&subscription)
+	err = r.collection.FindOne(ctx, filter).Decode(&subscription)
 	if err != nil {
 		if errors.Is(err, mongo.ErrNoDocuments) {
 			return nil, ErrSubscriptionNotFound // Subscription not found, return nil subscription
 		}
-		log.Printf("Error finding subscription: %v", err)
+		logger.FromContext(ctx).Error("error finding subscription", "subscriptionId", subscriptionId, "error", err)
 		return nil, err // An error occurred
 	}
 
@@ -77,19 +166,22 @@ func (r *MongoPaymentRepository) Get(subscriptionId string) (*models.Subscriptio
 }
 
 // GetByUserId a subscription by userId
-func (r *MongoPaymentRepository) GetByUserId(userId string) (*models.Subscription, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func (r *MongoPaymentRepository) GetByUserId(ctx context.Context, userId string) (_ *models.Subscription, err error) {
+	ctx, end := r.startOperation(ctx, "GetByUserId")
+	defer func() { end(err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
 	var subscription models.Subscription
 	filter := bson.M{"userId": userId}
 
-	err := r.collection.FindOne(ctx, filter).Decode(&subscription)
+	err = r.collection.FindOne(ctx, filter).Decode(&subscription)
 	if err != nil {
 		if errors.Is(err, mongo.ErrNoDocuments) {
 			return nil, ErrSubscriptionNotFound // Subscription not found, return nil subscription
 		}
-		log.Printf("Error finding subscription: %v", err)
+		logger.FromContext(ctx).Error("error finding subscription", "userId", userId, "error", err)
 		return nil, err // An error occurred
 	}
 
@@ -97,13 +189,16 @@ func (r *MongoPaymentRepository) GetByUserId(userId string) (*models.Subscriptio
 }
 
 // Update subscription
-func (r *MongoPaymentRepository) Update(subscription *models.Subscription) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func (r *MongoPaymentRepository) Update(ctx context.Context, subscription *models.Subscription) (err error) {
+	ctx, end := r.startOperation(ctx, "Update")
+	defer func() { end(err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
 	filter := bson.M{"subscriptionId": subscription.SubscriptionID}
 
-	_, err := r.collection.ReplaceOne(ctx, filter, subscription)
+	_, err = r.collection.ReplaceOne(ctx, filter, subscription)
 	if err != nil {
 		return ErrorUpdatingSubscription
 	}
@@ -112,13 +207,16 @@ func (r *MongoPaymentRepository) Update(subscription *models.Subscription) error
 }
 
 // Delete a subscription
-func (r *MongoPaymentRepository) Delete(subscriptionId string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func (r *MongoPaymentRepository) Delete(ctx context.Context, subscriptionId string) (err error) {
+	ctx, end := r.startOperation(ctx, "Delete")
+	defer func() { end(err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
 	filter := bson.M{"subscriptionId": subscriptionId}
 
-	_, err := r.collection.DeleteOne(ctx, filter)
+	_, err = r.collection.DeleteOne(ctx, filter)
 	if err != nil {
 		if errors.Is(err, mongo.ErrNoDocuments) {
 			return ErrSubscriptionNotFound
@@ -130,19 +228,73 @@ func (r *MongoPaymentRepository) Delete(subscriptionId string) error {
 	return nil
 }
 
+// ListValidByUserId lists the subscriptions of a user that currently grant access
+func (r *MongoPaymentRepository) ListValidByUserId(ctx context.Context, userId string) (_ []*models.Subscription, err error) {
+	ctx, end := r.startOperation(ctx, "ListValidByUserId")
+	defer func() { end(err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	cursor, err := r.collection.Find(ctx, bson.M{"userId": userId})
+	if err != nil {
+		logger.FromContext(ctx).Error("error listing subscriptions", "userId", userId, "error", err)
+		return nil, err
+	}
+
+	var subscriptions []*models.Subscription
+	err = cursor.All(ctx, &subscriptions)
+	if err != nil {
+		return nil, err
+	}
+
+	valid := make([]*models.Subscription, 0, len(subscriptions))
+	for _, subs := range subscriptions {
+		if r.isValid(subs) {
+			valid = append(valid, subs)
+		}
+	}
+	return valid, nil
+}
+
 // IsValid Check if a subscription is valid
-func (r *MongoPaymentRepository) IsValid(userId string) bool {
+func (r *MongoPaymentRepository) IsValid(ctx context.Context, userId string) bool {
+	ctx, end := r.startOperation(ctx, "IsValid")
+	defer end(nil)
 
-	subs, err := r.GetByUserId(userId)
+	valid, err := r.ListValidByUserId(ctx, userId)
 	if err != nil {
 		return false
 	}
+	return len(valid) > 0
+}
 
+// isValid checks if a subscription grants access right now
+func (r *MongoPaymentRepository) isValid(subs *models.Subscription) bool {
 	var isPremium bool
 
+	if subs.Pause != nil {
+		switch r.pausedAccess {
+		case PausedAccessAllow:
+		case PausedAccessPaidPeriod:
+			if !time.Now().Before(time.UnixMilli(subs.Pause.AccessEndsAt)) {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+
 	status := subs.Status
 	expiresAt := subs.EndsAt
 
+	if status == StatusPendingPayment {
+		if r.pendingAccess != PendingAccessAllow {
+			return false
+		}
+		return subs.IsOneTime && expiresAt == -1 || time.Now().Before(time.UnixMilli(expiresAt))
+	}
+
 	if subs.IsOneTime && (status == "active" || status == "paid" || status == "complete") && expiresAt == -1 {
 		return true
 	}
@@ -0,0 +1,169 @@
+package repository
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"process-payments/internal/models"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type TrialRepository interface {
+	// RecordUsage stores that each identity used a trial, identities already recorded keep their first usage
+	RecordUsage(ctx context.Context, identities []models.TrialIdentity, userId, subscriptionId string) error
+	// FindUsage returns the first recorded usage of the identities, ErrTrialUsageNotFound when none used a trial
+	FindUsage(ctx context.Context, identities []models.TrialIdentity) (*models.TrialUsage, error)
+	GetOverride(ctx context.Context, userId string) (*models.TrialOverride, error)
+	SetOverride(ctx context.Context, override *models.TrialOverride) error
+	DeleteOverride(ctx context.Context, userId string) error
+}
+
+type MongoTrialRepository struct {
+	usages    *mongo.Collection
+	overrides *mongo.Collection
+}
+
+// Errors
+var (
+	ErrTrialUsageNotFound    = errors.New("trial usage not found")
+	ErrTrialOverrideNotFound = errors.New("trial override not found")
+	ErrorSavingTrialUsage    = errors.New("error saving trial usage")
+)
+
+func NewMongoTrialRepository(usages, overrides *mongo.Collection) TrialRepository {
+	return &MongoTrialRepository{usages: usages, overrides: overrides}
+}
+
+func (r *MongoTrialRepository) startOperation(ctx context.Context, collection *mongo.Collection, operation string) (context.Context, func(error)) {
+	return startOperation(ctx, "trials", collection.Name(), operation)
+}
+
+// trialUsageId hashes an identity, emails are compared case-insensitively
+func trialUsageId(identity models.TrialIdentity) string {
+	value := identity.Value
+	if identity.Kind == models.TrialIdentityEmail {
+		value = strings.ToLower(strings.TrimSpace(value))
+	}
+	sum := sha256.Sum256([]byte(identity.Kind + ":" + value))
+	return hex.EncodeToString(sum[:])
+}
+
+// RecordUsage upserts a usage per identity, the unique _id keeps the first usage of each identity
+func (r *MongoTrialRepository) RecordUsage(ctx context.Context, identities []models.TrialIdentity, userId, subscriptionId string) (err error) {
+	ctx, end := r.startOperation(ctx, r.usages, "RecordUsage")
+	defer func() { end(err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	writes := make([]mongo.WriteModel, 0, len(identities))
+	for _, identity := range identities {
+		if identity.Value == "" {
+			continue
+		}
+		usage := models.TrialUsage{
+			ID:             trialUsageId(identity),
+			Kind:           identity.Kind,
+			UserId:         userId,
+			SubscriptionId: subscriptionId,
+			CreatedAt:      time.Now(),
+		}
+		writes = append(writes, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": usage.ID}).
+			SetUpdate(bson.M{"$setOnInsert": usage}).
+			SetUpsert(true))
+	}
+	if len(writes) == 0 {
+		return nil
+	}
+
+	_, err = r.usages.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return ErrorSavingTrialUsage
+	}
+	return nil
+}
+
+// FindUsage looks the identities up by their hash
+func (r *MongoTrialRepository) FindUsage(ctx context.Context, identities []models.TrialIdentity) (_ *models.TrialUsage, err error) {
+	ctx, end := r.startOperation(ctx, r.usages, "FindUsage")
+	defer func() { end(err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	ids := make([]string, 0, len(identities))
+	for _, identity := range identities {
+		if identity.Value != "" {
+			ids = append(ids, trialUsageId(identity))
+		}
+	}
+	if len(ids) == 0 {
+		return nil, ErrTrialUsageNotFound
+	}
+
+	var usage models.TrialUsage
+	err = r.usages.FindOne(ctx, bson.M{"_id": bson.M{"$in": ids}}, options.FindOne().SetSort(bson.M{"createdAt": 1})).Decode(&usage)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrTrialUsageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &usage, nil
+}
+
+// GetOverride returns the admin override of a user
+func (r *MongoTrialRepository) GetOverride(ctx context.Context, userId string) (_ *models.TrialOverride, err error) {
+	ctx, end := r.startOperation(ctx, r.overrides, "GetOverride")
+	defer func() { end(err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var override models.TrialOverride
+	err = r.overrides.FindOne(ctx, bson.M{"_id": userId}).Decode(&override)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrTrialOverrideNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &override, nil
+}
+
+// SetOverride creates or replaces the admin override of a user
+func (r *MongoTrialRepository) SetOverride(ctx context.Context, override *models.TrialOverride) (err error) {
+	ctx, end := r.startOperation(ctx, r.overrides, "SetOverride")
+	defer func() { end(err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err = r.overrides.ReplaceOne(ctx, bson.M{"_id": override.UserId}, override, options.Replace().SetUpsert(true))
+	return err
+}
+
+// DeleteOverride removes the admin override of a user, the recorded usages apply again
+func (r *MongoTrialRepository) DeleteOverride(ctx context.Context, userId string) (err error) {
+	ctx, end := r.startOperation(ctx, r.overrides, "DeleteOverride")
+	defer func() { end(err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	result, err := r.overrides.DeleteOne(ctx, bson.M{"_id": userId})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrTrialOverrideNotFound
+	}
+	return nil
+}
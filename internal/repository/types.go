@@ -1,5 +1,8 @@
 package repository
 
 type Collections struct {
-	PaymentCollection PaymentRepository
+	PaymentCollection     PaymentRepository
+	IdempotencyCollection IdempotencyRepository
+	TrialCollection       TrialRepository
+	CheckoutCollection    CheckoutRepository
 }
@@ -0,0 +1,13 @@
+package routes
+
+import (
+	"process-payments/internal/controllers"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HealthRoutes The `HealthRoutes` function sets up the liveness and readiness probes routes.
+func HealthRoutes(router *gin.RouterGroup) {
+	router.GET("/healthz", controllers.Healthz())
+	router.GET("/readyz", controllers.Readyz())
+}
@@ -0,0 +1,14 @@
+package routes
+
+import (
+	"process-payments/internal/controllers"
+
+	"github.com/gin-gonic/gin"
+)
+
+// InternalRoutes The `InternalRoutes` function sets up the routes reserved to our internal services.
+func InternalRoutes(router *gin.RouterGroup) {
+	router.GET("/trials/:userId", controllers.GetTrialEligibility())
+	router.PUT("/trials/:userId/override", controllers.SetTrialOverride())
+	router.DELETE("/trials/:userId/override", controllers.DeleteTrialOverride())
+}
@@ -2,13 +2,15 @@ package routes
 
 import (
 	"process-payments/internal/controllers"
+	"process-payments/internal/middlewares"
+	"process-payments/internal/repository"
 
 	"github.com/gin-gonic/gin"
 )
 
 // StripeRoutes The `StripeRoutes` function sets up webhook routes for logging in and generating authentication
 // URLs.
-func StripeRoutes(router *gin.RouterGroup) {
+func StripeRoutes(router *gin.RouterGroup, rateLimiter *middlewares.RateLimiter, idempotencyRepository repository.IdempotencyRepository) {
 	router.Use(func(c *gin.Context) {
 		c.Set("userId", "123")
 		c.Next()
@@ -18,5 +20,19 @@ func StripeRoutes(router *gin.RouterGroup) {
 	router.POST("/webhooks", controllers.HandleStripeWebhooks())
 
 	// Checkout
-	router.GET("/", controllers.CreateStripeCheckout())
+	router.GET("/catalog", rateLimiter.Limit("catalog"), controllers.GetCatalog())
+	router.GET("/", rateLimiter.Limit("checkout"), controllers.CreateStripeCheckout())
+	router.POST("/checkout", rateLimiter.Limit("checkout"), middlewares.Idempotency(idempotencyRepository), controllers.CreateCheckout())
+	router.GET("/checkout/:sessionId", controllers.GetCheckoutStatus())
+	router.POST("/checkout/:sessionId/fulfill", controllers.FulfillCheckout())
+	router.GET("/checkouts/abandoned", controllers.ListAbandonedCheckouts())
+
+	// Subscriptions
+	router.GET("/entitlement", controllers.GetEntitlement())
+	router.POST("/subscriptions/:subscriptionId/plan/preview", controllers.PreviewPlanChange())
+	router.POST("/subscriptions/:subscriptionId/plan", middlewares.Idempotency(idempotencyRepository), controllers.ChangePlan())
+	router.POST("/subscriptions/:subscriptionId/cancel", controllers.CancelSubscription())
+	router.POST("/subscriptions/:subscriptionId/resume", controllers.ResumeSubscription())
+	router.POST("/subscriptions/:subscriptionId/pause", controllers.PauseBilling())
+	router.DELETE("/subscriptions/:subscriptionId/pause", controllers.ResumeBilling())
 }
@@ -0,0 +1,118 @@
+package secrets
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EncryptedFileProvider reads secrets from a local JSON object of name/value pairs, encrypted with AES-256-GCM.
+// The file is decrypted again whenever it changes on disk.
+type EncryptedFileProvider struct {
+	path string
+	aead cipher.AEAD
+
+	mu      sync.Mutex
+	values  map[string]string
+	modTime time.Time
+	size    int64
+}
+
+// NewEncryptedFileProvider creates a provider for the secrets file at path.
+// The base64 encoded 32 bytes key is read from keyFile, or from the SECRETS_KEY env var when keyFile is empty.
+func NewEncryptedFileProvider(path, keyFile string) (*EncryptedFileProvider, error) {
+	encodedKey := os.Getenv("SECRETS_KEY")
+	if keyFile != "" {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+		}
+		encodedKey = string(data)
+	}
+
+	aead, err := NewCipher(encodedKey)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedFileProvider{path: path, aead: aead}, nil
+}
+
+// NewCipher creates the AES-256-GCM cipher for a base64 encoded 32 bytes key
+func NewCipher(encodedKey string) (cipher.AEAD, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encodedKey))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%w: expected a base64 encoded 32 bytes key", ErrInvalidKey)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt seals the secrets with aead, the nonce is prepended to the ciphertext
+func Encrypt(aead cipher.AEAD, values map[string]string) ([]byte, error) {
+	plaintext, err := json.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Decrypt opens secrets sealed by Encrypt
+func Decrypt(aead cipher.AEAD, data []byte) (map[string]string, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, ErrDecryptingFile
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDecryptingFile, err)
+	}
+
+	var values map[string]string
+	if err := json.Unmarshal(plaintext, &values); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDecryptingFile, err)
+	}
+	return values, nil
+}
+
+func (p *EncryptedFileProvider) Get(_ context.Context, name string) (string, error) {
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return "", fmt.Errorf("%w %s: %v", ErrReadingSecret, name, err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.values == nil || !p.modTime.Equal(info.ModTime()) || p.size != info.Size() {
+		data, err := os.ReadFile(p.path)
+		if err != nil {
+			return "", fmt.Errorf("%w %s: %v", ErrReadingSecret, name, err)
+		}
+		values, err := Decrypt(p.aead, data)
+		if err != nil {
+			return "", err
+		}
+		p.values, p.modTime, p.size = values, info.ModTime(), info.Size()
+	}
+
+	value, ok := p.values[name]
+	if !ok || value == "" {
+		return "", ErrSecretNotFound
+	}
+	return value, nil
+}
@@ -0,0 +1,153 @@
+package secrets
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestKey(t *testing.T) string {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// writeSecretsFile encrypts the secrets with key and writes them to path with the given modification time
+func writeSecretsFile(t *testing.T, path, key string, values map[string]string, modTime time.Time) {
+	t.Helper()
+	aead, err := NewCipher(key)
+	if err != nil {
+		t.Fatalf("NewCipher error = %v", err)
+	}
+	data, err := Encrypt(aead, values)
+	if err != nil {
+		t.Fatalf("Encrypt error = %v", err)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	aead, err := NewCipher(newTestKey(t))
+	if err != nil {
+		t.Fatalf("NewCipher error = %v", err)
+	}
+	values := map[string]string{StripeSecretKey: "sk_test_123", StripeWebhookSecretKey: "whsec_123"}
+
+	data, err := Encrypt(aead, values)
+	if err != nil {
+		t.Fatalf("Encrypt error = %v", err)
+	}
+	got, err := Decrypt(aead, data)
+	if err != nil {
+		t.Fatalf("Decrypt error = %v", err)
+	}
+	if len(got) != len(values) {
+		t.Fatalf("Decrypt = %v, want %v", got, values)
+	}
+	for name, value := range values {
+		if got[name] != value {
+			t.Errorf("Decrypt()[%q] = %q, want %q", name, got[name], value)
+		}
+	}
+}
+
+func TestDecryptTampered(t *testing.T) {
+	aead, err := NewCipher(newTestKey(t))
+	if err != nil {
+		t.Fatalf("NewCipher error = %v", err)
+	}
+	data, err := Encrypt(aead, map[string]string{StripeSecretKey: "sk_test_123"})
+	if err != nil {
+		t.Fatalf("Encrypt error = %v", err)
+	}
+
+	tests := map[string][]byte{
+		"flipped ciphertext byte": append(append([]byte{}, data[:len(data)-1]...), data[len(data)-1]^1),
+		"flipped nonce byte":      append([]byte{data[0] ^ 1}, data[1:]...),
+		"truncated":               data[:len(data)-1],
+		"shorter than the nonce":  data[:aead.NonceSize()-1],
+	}
+	for name, tampered := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Decrypt(aead, tampered); !errors.Is(err, ErrDecryptingFile) {
+				t.Errorf("Decrypt error = %v, want %v", err, ErrDecryptingFile)
+			}
+		})
+	}
+}
+
+func TestDecryptWrongKey(t *testing.T) {
+	aead, err := NewCipher(newTestKey(t))
+	if err != nil {
+		t.Fatalf("NewCipher error = %v", err)
+	}
+	data, err := Encrypt(aead, map[string]string{StripeSecretKey: "sk_test_123"})
+	if err != nil {
+		t.Fatalf("Encrypt error = %v", err)
+	}
+
+	otherAead, err := NewCipher(newTestKey(t))
+	if err != nil {
+		t.Fatalf("NewCipher error = %v", err)
+	}
+	if _, err := Decrypt(otherAead, data); !errors.Is(err, ErrDecryptingFile) {
+		t.Errorf("Decrypt error = %v, want %v", err, ErrDecryptingFile)
+	}
+}
+
+func TestNewCipherInvalidKey(t *testing.T) {
+	for _, key := range []string{"", "not base64!", base64.StdEncoding.EncodeToString(make([]byte, 16))} {
+		if _, err := NewCipher(key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("NewCipher(%q) error = %v, want %v", key, err, ErrInvalidKey)
+		}
+	}
+}
+
+func TestEncryptedFileProviderReload(t *testing.T) {
+	dir := t.TempDir()
+	key := newTestKey(t)
+	keyFile := filepath.Join(dir, "secrets.key")
+	if err := os.WriteFile(keyFile, []byte(key+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "secrets.enc")
+	modTime := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	writeSecretsFile(t, path, key, map[string]string{StripeSecretKey: "sk_test_old"}, modTime)
+
+	provider, err := NewEncryptedFileProvider(path, keyFile)
+	if err != nil {
+		t.Fatalf("NewEncryptedFileProvider error = %v", err)
+	}
+	ctx := context.Background()
+	if got, err := provider.Get(ctx, StripeSecretKey); err != nil || got != "sk_test_old" {
+		t.Fatalf("Get = %q, %v, want %q", got, err, "sk_test_old")
+	}
+	if _, err := provider.Get(ctx, StripeWebhookSecretKey); !errors.Is(err, ErrSecretNotFound) {
+		t.Errorf("Get missing secret error = %v, want %v", err, ErrSecretNotFound)
+	}
+
+	// Rotate the secret, the new value has the same size so only the modification time changes
+	writeSecretsFile(t, path, key, map[string]string{StripeSecretKey: "sk_test_new"}, modTime.Add(time.Second))
+	if got, err := provider.Get(ctx, StripeSecretKey); err != nil || got != "sk_test_new" {
+		t.Errorf("Get after rotation = %q, %v, want %q", got, err, "sk_test_new")
+	}
+
+	// A file encrypted with another key is refused
+	writeSecretsFile(t, path, newTestKey(t), map[string]string{StripeSecretKey: "sk_test_other"}, modTime.Add(2*time.Second))
+	if _, err := provider.Get(ctx, StripeSecretKey); !errors.Is(err, ErrDecryptingFile) {
+		t.Errorf("Get with the wrong key error = %v, want %v", err, ErrDecryptingFile)
+	}
+}
@@ -0,0 +1,21 @@
+package secrets
+
+import (
+	"context"
+	"os"
+)
+
+// EnvProvider reads secrets from the environment variables of the same name
+type EnvProvider struct{}
+
+func NewEnvProvider() *EnvProvider {
+	return &EnvProvider{}
+}
+
+func (p *EnvProvider) Get(_ context.Context, name string) (string, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return "", ErrSecretNotFound
+	}
+	return value, nil
+}
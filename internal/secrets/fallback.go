@@ -0,0 +1,25 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+)
+
+// fallbackProvider answers from static values when the wrapped provider doesn't know a secret
+type fallbackProvider struct {
+	provider Provider
+	values   map[string]string
+}
+
+// WithFallback wraps provider so that secrets it doesn't hold are read from values, e.g. the ones set in the config file
+func WithFallback(provider Provider, values map[string]string) Provider {
+	return &fallbackProvider{provider: provider, values: values}
+}
+
+func (p *fallbackProvider) Get(ctx context.Context, name string) (string, error) {
+	value, err := p.provider.Get(ctx, name)
+	if errors.Is(err, ErrSecretNotFound) && p.values[name] != "" {
+		return p.values[name], nil
+	}
+	return value, err
+}
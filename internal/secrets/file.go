@@ -0,0 +1,65 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileProvider reads secrets mounted as files, one file per secret named after it (Kubernetes style).
+// A file is read again whenever it changes on disk.
+type FileProvider struct {
+	dir   string
+	mu    sync.Mutex
+	cache map[string]cachedFile
+}
+
+type cachedFile struct {
+	value   string
+	modTime time.Time
+	size    int64
+}
+
+func NewFileProvider(dir string) *FileProvider {
+	return &FileProvider{
+		dir:   dir,
+		cache: make(map[string]cachedFile),
+	}
+}
+
+func (p *FileProvider) Get(_ context.Context, name string) (string, error) {
+	path := filepath.Join(p.dir, name)
+
+	// Stat follows the symlinks Kubernetes swaps on rotation, so a new secret shows up as a changed file
+	info, err := os.Stat(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", ErrSecretNotFound
+		}
+		return "", fmt.Errorf("%w %s: %v", ErrReadingSecret, name, err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if cached, ok := p.cache[name]; ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.value, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("%w %s: %v", ErrReadingSecret, name, err)
+	}
+	value := strings.TrimSpace(string(data))
+	if value == "" {
+		return "", ErrSecretNotFound
+	}
+
+	p.cache[name] = cachedFile{value: value, modTime: info.ModTime(), size: info.Size()}
+	return value, nil
+}
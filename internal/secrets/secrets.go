@@ -0,0 +1,65 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Secret names
+const (
+	StripeSecretKey        = "STRIPE_SECRET_KEY"
+	StripeWebhookSecretKey = "STRIPE_WEBHOOK_SECRET_KEY"
+	MongoURI               = "MONGO_URI"
+	// NotificationWebhookSecret signs the notifications posted to notifications.webhookUrl, optional
+	NotificationWebhookSecret = "NOTIFICATION_WEBHOOK_SECRET"
+)
+
+// Providers
+const (
+	ProviderEnv       = "env"
+	ProviderFile      = "file"
+	ProviderEncrypted = "encrypted"
+)
+
+var (
+	ErrSecretNotFound  = errors.New("secret not found")
+	ErrUnknownProvider = errors.New("unknown secret provider")
+	ErrReadingSecret   = errors.New("error reading secret")
+	ErrDecryptingFile  = errors.New("error decrypting secrets file")
+	ErrInvalidKey      = errors.New("invalid secrets key")
+)
+
+// Provider gives access to secrets. Implementations return the current value on every call,
+// so rotated secrets are picked up without a restart.
+type Provider interface {
+	// Get returns the current value of the named secret, or ErrSecretNotFound
+	Get(ctx context.Context, name string) (string, error)
+}
+
+// Config selects and configures a provider
+type Config struct {
+	// Provider is env, file or encrypted
+	Provider string `yaml:"provider"`
+	// Dir is the directory of the file provider, holding one file per secret
+	Dir string `yaml:"dir"`
+	// File is the path of the encrypted provider secrets file
+	File string `yaml:"file"`
+	// KeyFile is the path of the file holding the base64 encryption key of the encrypted provider.
+	// The SECRETS_KEY env var is used when it is empty.
+	KeyFile string `yaml:"keyFile"`
+}
+
+// New creates the provider described by cfg
+func New(cfg Config) (Provider, error) {
+	switch cfg.Provider {
+	case ProviderEnv, "":
+		return NewEnvProvider(), nil
+	case ProviderFile:
+		return NewFileProvider(cfg.Dir), nil
+	case ProviderEncrypted:
+		return NewEncryptedFileProvider(cfg.File, cfg.KeyFile)
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownProvider, cfg.Provider)
+	}
+}
@@ -3,22 +3,26 @@ package server
 import (
 	"context"
 	"errors"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"process-payments/internal/config"
+	"process-payments/internal/database"
+	"process-payments/internal/metrics"
 	"process-payments/internal/middlewares"
+	"process-payments/internal/ratelimit"
 	"process-payments/internal/routes"
 	"syscall"
 	"time"
 
 	"github.com/gin-contrib/secure"
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 )
 
 func StartServer(cfg *config.Config) {
-	log.Println("Starting server...")
+	slog.Info("starting server", "port", cfg.Port, "tls", cfg.TLS.Enabled(), "mutualTLS", cfg.TLS.ClientCAFile != "")
 	gin.SetMode(gin.ReleaseMode)
 	if !cfg.Production {
 		gin.SetMode(gin.DebugMode)
@@ -42,23 +46,70 @@ func StartServer(cfg *config.Config) {
 
 	router.Use(gin.Recovery())
 
+	// Tracing, started before logging so log lines carry the trace ID
+	router.Use(otelgin.Middleware(cfg.AppName))
+
 	// Logging, security, metrics and utils middleware
+	router.Use(middlewares.RequestID())
 	router.Use(middlewares.CustomLogger())
-	router.Use(middlewares.CORSMiddleware(cfg.ClientURL, cfg.Production))
+	router.Use(middlewares.Metrics())
+	router.Use(middlewares.CORSMiddleware(cfg.ClientURL, cfg.CORS.DevOrigins, cfg.Production))
+
+	// Liveness and readiness probes
+	routes.HealthRoutes(router.Group("/"))
+
+	rateLimiter, err := newRateLimiter(cfg)
+	if err != nil {
+		slog.Error("error creating rate limiter", "error", err)
+		os.Exit(1)
+	}
 
 	api := router.Group("/api")
 	{
-		routes.StripeRoutes(api.Group("/stripe"))
+		routes.StripeRoutes(api.Group("/stripe"), rateLimiter, cfg.Collections.IdempotencyCollection)
+
+		// Internal routes require a client certificate once mTLS is configured, and are never served unprotected in production
+		mutualTLS := cfg.TLS.ClientCAFile != ""
+		if mutualTLS {
+			routes.InternalRoutes(api.Group("/internal", middlewares.RequireClientCert()))
+		} else if !cfg.Production {
+			routes.InternalRoutes(api.Group("/internal"))
+		}
+	}
+
+	publicTLS, adminTLS, err := tlsConfigs(cfg.TLS)
+	if err != nil {
+		slog.Error("error loading TLS configuration", "error", err)
+		os.Exit(1)
 	}
 
 	srv := &http.Server{
-		Addr:    ":" + cfg.Port,
-		Handler: router,
+		Addr:      ":" + cfg.Port,
+		Handler:   router,
+		TLSConfig: publicTLS,
+	}
+
+	// Admin server, kept on a separate port so it is never exposed with the public API
+	adminMux := http.NewServeMux()
+	adminMux.Handle("/metrics", metrics.Handler())
+	adminSrv := &http.Server{
+		Addr:      ":" + cfg.AdminPort,
+		Handler:   adminMux,
+		TLSConfig: adminTLS,
 	}
 
 	go func() {
-		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			log.Fatalf("listen: %s\n", err)
+		if err := listen(srv); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("listen", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	go func() {
+		slog.Info("starting admin server", "port", cfg.AdminPort, "tls", adminTLS != nil)
+		if err := listen(adminSrv); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("admin listen", "error", err)
+			os.Exit(1)
 		}
 	}()
 
@@ -66,13 +117,51 @@ func StartServer(cfg *config.Config) {
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
-	log.Println("Shutting down server...")
+	slog.Info("shutting down server")
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
+	if err := adminSrv.Shutdown(ctx); err != nil {
+		slog.Error("admin server forced to shutdown", "error", err)
+	}
 	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatal("Server forced to shutdown:", err)
+		slog.Error("server forced to shutdown", "error", err)
+		os.Exit(1)
+	}
+
+	// Let the webhook workers finish the queued events
+	if err := cfg.Services.WebhookQueue.Stop(ctx); err != nil {
+		slog.Error("webhook queue forced to stop", "error", err)
 	}
 
-	log.Println("Server exiting")
+	slog.Info("server exiting")
+}
+
+// listen serves over TLS when the server has a TLS configuration, the certificates come from its GetCertificate
+func listen(srv *http.Server) error {
+	if srv.TLSConfig != nil {
+		return srv.ListenAndServeTLS("", "")
+	}
+	return srv.ListenAndServe()
+}
+
+// newRateLimiter creates the rate limiter of the route groups, backed by the configured store
+func newRateLimiter(cfg *config.Config) (*middlewares.RateLimiter, error) {
+	var store ratelimit.Store = ratelimit.NewMemoryStore()
+	if cfg.RateLimit.Store == ratelimit.StoreMongo {
+		mongoStore, err := ratelimit.NewMongoStore(context.Background(), database.OpenCollection(cfg.MongoClient, cfg.Mongo.Database, "rateLimits"))
+		if err != nil {
+			return nil, err
+		}
+		store = mongoStore
+	}
+
+	policies := make(map[string]middlewares.RateLimitPolicy, len(cfg.RateLimit.Groups))
+	for group, limits := range cfg.RateLimit.Groups {
+		policies[group] = middlewares.RateLimitPolicy{
+			PerUser: limits.PerUser.Limit(),
+			PerIP:   limits.PerIP.Limit(),
+		}
+	}
+	return middlewares.NewRateLimiter(store, policies), nil
 }
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"process-payments/internal/config"
+	"sync"
+	"time"
+)
+
+var ErrInvalidClientCA = errors.New("invalid client CA file")
+
+// certReloader serves the certificate from the cert and key files, loading them again when they change on disk
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	certMod, keyMod, err := r.modTimes()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(certMod, keyMod); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+func (r *certReloader) load(certMod, keyMod time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert, r.certMod, r.keyMod = &cert, certMod, keyMod
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate. A certificate that fails to load keeps the previous one in use.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	certMod, keyMod, err := r.modTimes()
+	if err != nil {
+		slog.Error("error checking TLS certificate files", "error", err)
+		return r.cert, nil
+	}
+	if certMod.Equal(r.certMod) && keyMod.Equal(r.keyMod) {
+		return r.cert, nil
+	}
+
+	if err := r.load(certMod, keyMod); err != nil {
+		// Cert and key are often not replaced at the exact same time, the next handshake tries again
+		slog.Error("error reloading TLS certificate", "error", err)
+		return r.cert, nil
+	}
+	slog.Info("TLS certificate reloaded", "certFile", r.certFile)
+	return r.cert, nil
+}
+
+// tlsConfigs builds the TLS configurations of the public and admin servers, both nil when TLS is disabled.
+// With a client CA, the public server asks for client certificates without requiring them, so the internal routes
+// can check them while the public and webhook routes stay reachable. The admin server requires them.
+func tlsConfigs(cfg config.TLSConfig) (*tls.Config, *tls.Config, error) {
+	if !cfg.Enabled() {
+		return nil, nil, nil
+	}
+
+	reloader, err := newCertReloader(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	public := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	admin := public.Clone()
+
+	if cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrInvalidClientCA, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("%w: no certificate found in %s", ErrInvalidClientCA, cfg.ClientCAFile)
+		}
+
+		public.ClientCAs = pool
+		public.ClientAuth = tls.VerifyClientCertIfGiven
+		admin.ClientCAs = pool
+		admin.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return public, admin, nil
+}
@@ -0,0 +1,160 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"process-payments/internal/logger"
+	"process-payments/internal/models"
+	"process-payments/internal/repository"
+	"time"
+
+	"github.com/stripe/stripe-go/v82"
+)
+
+// Handling abandoned checkout errors
+var (
+	ErrorListingAbandonedCheckouts = errors.New("error listing abandoned checkouts")
+)
+
+// applyRecovery asks Stripe for a recovery URL when the checkout expires, so that the user can finish it later.
+// Only checkouts on the hosted payment page can be recovered.
+func (s *StripeService) applyRecovery(checkoutParams *stripe.CheckoutSessionParams, uiMode string) {
+	if !s.settings.CheckoutRecovery || uiMode == CheckoutUIEmbedded {
+		return
+	}
+	checkoutParams.AfterExpiration = &stripe.CheckoutSessionAfterExpirationParams{
+		Recovery: &stripe.CheckoutSessionAfterExpirationRecoveryParams{
+			Enabled: stripe.Bool(true),
+		},
+	}
+}
+
+// recordCheckout records a created checkout session with the main item of its cart.
+// The checkout goes on when it can't be recorded, only the abandoned checkout tracking misses it.
+func (s *StripeService) recordCheckout(ctx context.Context, sessionData *stripe.CheckoutSession, line checkoutLine) {
+	checkout := &models.CheckoutSession{
+		SessionId: sessionData.ID,
+		UserId:    sessionData.ClientReferenceID,
+		ProductId: line.price.Product.ID,
+		PriceId:   line.price.ID,
+		Mode:      string(sessionData.Mode),
+		Amount:    float32(sessionData.AmountTotal) / 100,
+		Currency:  string(sessionData.Currency),
+		Status:    models.CheckoutStatusOpen,
+		CreatedAt: sessionData.Created * 1000,
+		ExpiresAt: sessionData.ExpiresAt * 1000,
+	}
+	err := s.repo.CheckoutCollection.Save(ctx, checkout)
+	if err != nil {
+		logger.FromContext(ctx).Error("error recording checkout session", "sessionId", sessionData.ID, "error", err)
+	}
+}
+
+// recordCheckoutCompletion marks a completed checkout session, and the expired session it was recovered from.
+// Failures are only logged, they must not block the fulfillment.
+func (s *StripeService) recordCheckoutCompletion(ctx context.Context, checkoutSession stripe.CheckoutSession) {
+	log := logger.FromContext(ctx)
+
+	err := s.repo.CheckoutCollection.Complete(ctx, checkoutSession.ID, time.Now().UnixMilli())
+	if err != nil && !errors.Is(err, repository.ErrCheckoutNotFound) {
+		log.Error("error recording checkout completion", "sessionId", checkoutSession.ID, "error", err)
+	}
+	if checkoutSession.RecoveredFrom == "" {
+		return
+	}
+	err = s.repo.CheckoutCollection.Recover(ctx, checkoutSession.RecoveredFrom, checkoutSession.ID)
+	if err != nil && !errors.Is(err, repository.ErrCheckoutNotFound) {
+		log.Error("error recording checkout recovery", "sessionId", checkoutSession.RecoveredFrom, "error", err)
+	}
+}
+
+// handleCheckoutExpired records an abandoned checkout session with its recovery URL.
+// Sessions created before the tracking, or whose creation could not be recorded, are recorded from the event.
+func (s *StripeService) handleCheckoutExpired(ctx context.Context, checkoutSession stripe.CheckoutSession) error {
+	ctx = logger.With(ctx, "sessionId", checkoutSession.ID)
+	log := logger.FromContext(ctx)
+
+	var recoveryURL string
+	var recoveryExpiresAt int64
+	if checkoutSession.AfterExpiration != nil && checkoutSession.AfterExpiration.Recovery != nil {
+		recoveryURL = checkoutSession.AfterExpiration.Recovery.URL
+		recoveryExpiresAt = checkoutSession.AfterExpiration.Recovery.ExpiresAt * 1000
+	}
+	expiredAt := time.Now().UnixMilli()
+
+	err := s.repo.CheckoutCollection.Expire(ctx, checkoutSession.ID, expiredAt, recoveryURL, recoveryExpiresAt)
+	if !errors.Is(err, repository.ErrCheckoutNotFound) {
+		if err != nil {
+			log.Error("error recording checkout expiration", "error", err)
+		}
+		return err
+	}
+
+	if checkoutSession.ClientReferenceID == "" {
+		log.Error("error recording checkout expiration", "error", ErrCustomUserIdNotExist)
+		return ErrCustomUserIdNotExist
+	}
+	items, err := s.sessionItems(ctx, checkoutSession.ID)
+	if err != nil {
+		return err
+	}
+	checkout := &models.CheckoutSession{
+		SessionId:         checkoutSession.ID,
+		UserId:            checkoutSession.ClientReferenceID,
+		Mode:              string(checkoutSession.Mode),
+		Amount:            float32(checkoutSession.AmountTotal) / 100,
+		Currency:          string(checkoutSession.Currency),
+		Status:            models.CheckoutStatusExpired,
+		RecoveryURL:       recoveryURL,
+		RecoveryExpiresAt: recoveryExpiresAt,
+		CreatedAt:         checkoutSession.Created * 1000,
+		ExpiresAt:         checkoutSession.ExpiresAt * 1000,
+		ExpiredAt:         expiredAt,
+	}
+	if len(items) > 0 {
+		checkout.ProductId = items[0].ProductId
+		checkout.PriceId = items[0].PriceId
+	}
+	err = s.repo.CheckoutCollection.Save(ctx, checkout)
+	if err != nil {
+		log.Error("error recording checkout expiration", "error", err)
+		return err
+	}
+	return nil
+}
+
+// ListAbandonedCheckouts returns the latest abandoned checkout of each product the user has no access to, the latest first.
+// Checkouts whose recovery URL expired are still listed, without the URL.
+func (s *StripeService) ListAbandonedCheckouts(ctx context.Context, userId string) ([]*models.CheckoutSession, error) {
+	log := logger.FromContext(ctx)
+
+	checkouts, err := s.repo.CheckoutCollection.ListAbandonedByUserId(ctx, userId)
+	if err != nil {
+		log.Error("error listing abandoned checkouts", "error", err)
+		return nil, ErrorListingAbandonedCheckouts
+	}
+	subscriptions, err := s.repo.PaymentCollection.ListValidByUserId(ctx, userId)
+	if err != nil {
+		log.Error("error listing subscriptions", "error", err)
+		return nil, ErrorListingAbandonedCheckouts
+	}
+
+	// Products bought since then are not abandoned anymore
+	skipped := make(map[string]bool, len(subscriptions))
+	for _, subscription := range subscriptions {
+		skipped[subscription.Plan.ProductId] = true
+	}
+	abandoned := make([]*models.CheckoutSession, 0, len(checkouts))
+	for _, checkout := range checkouts {
+		if skipped[checkout.ProductId] {
+			continue
+		}
+		skipped[checkout.ProductId] = true
+		if checkout.RecoveryExpiresAt > 0 && !time.Now().Before(time.UnixMilli(checkout.RecoveryExpiresAt)) {
+			checkout.RecoveryURL = ""
+			checkout.RecoveryExpiresAt = 0
+		}
+		abandoned = append(abandoned, checkout)
+	}
+	return abandoned, nil
+}
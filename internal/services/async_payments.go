@@ -0,0 +1,114 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"process-payments/internal/logger"
+	"process-payments/internal/repository"
+	"time"
+
+	"github.com/stripe/stripe-go/v82"
+)
+
+// Delayed notification payment methods, such as SEPA Debit, Bacs, Boleto or bank transfers, complete the checkout
+// before the payment succeeds. The purchase is recorded as pending, whether it grants access follows subscriptions.pendingAccess,
+// and Stripe tells whether the payment succeeded with the async payment events, days later.
+
+// checkoutPaymentStatus returns the status a completed checkout is recorded with, pending while its payment is not confirmed
+func checkoutPaymentStatus(checkoutSession stripe.CheckoutSession, status string) string {
+	if checkoutSession.PaymentStatus == stripe.CheckoutSessionPaymentStatusUnpaid {
+		return repository.StatusPendingPayment
+	}
+	return status
+}
+
+// subscriptionUpdateStatus returns the status of a subscription after an update. Stripe reports subscriptions waiting for
+// their first delayed payment as active, they stay pending or failed until the async payment events.
+func subscriptionUpdateStatus(current string, status stripe.SubscriptionStatus) string {
+	waiting := current == repository.StatusPendingPayment || current == repository.StatusPaymentFailed
+	if waiting && (status == stripe.SubscriptionStatusActive || status == stripe.SubscriptionStatusTrialing) {
+		return current
+	}
+	return string(status)
+}
+
+// handleAsyncPaymentSucceeded grants the purchase of a checkout whose delayed payment succeeded
+func (s *StripeService) handleAsyncPaymentSucceeded(ctx context.Context, checkoutSession stripe.CheckoutSession) error {
+	ctx = logger.With(ctx, "sessionId", checkoutSession.ID)
+	log := logger.FromContext(ctx)
+
+	recordId := checkoutRecordId(checkoutSession)
+	if recordId == "" {
+		log.Error("error handling delayed payment", "error", ErrSubscriptionNotFound)
+		return ErrSubscriptionNotFound
+	}
+	purchase, err := s.repo.PaymentCollection.Get(ctx, recordId)
+	if errors.Is(err, repository.ErrSubscriptionNotFound) {
+		// The completion was missed, the checkout is recorded as paid
+		return s.fulfillCheckout(ctx, checkoutSession)
+	}
+	if err != nil {
+		log.Error("error getting subscription", "subscriptionId", recordId, "error", err)
+		return err
+	}
+
+	status := string(checkoutSession.PaymentStatus)
+	if checkoutSession.Mode == stripe.CheckoutSessionModeSubscription {
+		subscriptionData, err := s.GetSubscription(ctx, recordId)
+		if err != nil {
+			return err
+		}
+		status = string(subscriptionData.Status)
+	}
+	purchase.Status = status
+	purchase.UpdatedAt = time.Now().UnixMilli()
+	err = s.repo.PaymentCollection.Update(ctx, purchase)
+	if err != nil {
+		log.Error("error updating payment", "error", err)
+		return err
+	}
+
+	log.Info("delayed payment succeeded", "subscriptionId", recordId, "status", status)
+	return nil
+}
+
+// handleAsyncPaymentFailed withdraws the purchase of a checkout whose delayed payment failed and notifies the user
+func (s *StripeService) handleAsyncPaymentFailed(ctx context.Context, checkoutSession stripe.CheckoutSession) error {
+	ctx = logger.With(ctx, "sessionId", checkoutSession.ID)
+	log := logger.FromContext(ctx)
+
+	recordId := checkoutRecordId(checkoutSession)
+	if recordId == "" {
+		log.Error("error handling delayed payment", "error", ErrSubscriptionNotFound)
+		return ErrSubscriptionNotFound
+	}
+	purchase, err := s.repo.PaymentCollection.Get(ctx, recordId)
+	if errors.Is(err, repository.ErrSubscriptionNotFound) {
+		// The completion was missed, the checkout is recorded before being marked as failed
+		err = s.fulfillCheckout(ctx, checkoutSession)
+		if err != nil {
+			return err
+		}
+		purchase, err = s.repo.PaymentCollection.Get(ctx, recordId)
+	}
+	if err != nil {
+		log.Error("error getting subscription", "subscriptionId", recordId, "error", err)
+		return err
+	}
+
+	purchase.Status = repository.StatusPaymentFailed
+	purchase.UpdatedAt = time.Now().UnixMilli()
+	err = s.repo.PaymentCollection.Update(ctx, purchase)
+	if err != nil {
+		log.Error("error updating payment", "error", err)
+		return err
+	}
+
+	// The failure is recorded, a retry of the event would only notify the user twice
+	err = s.notifier.PaymentFailed(ctx, purchase)
+	if err != nil {
+		log.Error("error notifying payment failure", "error", err)
+	}
+
+	return nil
+}
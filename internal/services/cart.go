@@ -0,0 +1,218 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"process-payments/internal/logger"
+	"process-payments/internal/models"
+	"process-payments/pkg/types"
+	"slices"
+
+	"github.com/stripe/stripe-go/v82"
+)
+
+// Handling cart errors
+var (
+	ErrEmptyCart               = errors.New("checkout has no item")
+	ErrDuplicateCartItem       = errors.New("a price can only be added once to the cart")
+	ErrInvalidQuantityBounds   = errors.New("quantity must be between minQuantity and maxQuantity")
+	ErrMixedBillingIntervals   = errors.New("recurring items must share the same billing interval")
+	ErrMixedCurrencies         = errors.New("every item must be in the same currency")
+	ErrorGettingCheckoutItems  = errors.New("error getting checkout line items")
+	ErrorSavingOneTimePurchase = errors.New("error saving one-time purchase")
+)
+
+// checkoutLine is a cart item resolved against the catalog
+type checkoutLine struct {
+	price *stripe.Price
+	item  types.CheckoutItem
+}
+
+// checkoutLines resolves the items of a checkout request, the main product comes first.
+// Every price must be an active price of a sold product, it is replaced by its price in the region of the customer.
+func (s *StripeService) checkoutLines(ctx context.Context, request types.StripeCheckoutRequest, region *PricingRegion) ([]checkoutLine, error) {
+	items := request.Items
+	if request.ProductId != "" {
+		items = append([]types.CheckoutItem{{
+			ProductId: request.ProductId,
+			PriceId:   request.PriceId,
+			Quantity:  request.Quantity,
+		}}, items...)
+	}
+	if len(items) == 0 {
+		return nil, ErrEmptyCart
+	}
+
+	lines := make([]checkoutLine, 0, len(items))
+	seen := make(map[string]bool, len(items))
+	var interval *stripe.PriceRecurring
+	for _, item := range items {
+		price, err := s.cartPrice(ctx, item)
+		if err != nil {
+			return nil, err
+		}
+		price, err = s.regionalPrice(ctx, region, price)
+		if err != nil {
+			return nil, err
+		}
+		if seen[price.ID] {
+			return nil, ErrDuplicateCartItem
+		}
+		seen[price.ID] = true
+
+		if item.Quantity < 1 {
+			item.Quantity = 1
+		}
+		if item.MaxQuantity > 0 && (item.MinQuantity > item.MaxQuantity || item.Quantity < item.MinQuantity || item.Quantity > item.MaxQuantity) {
+			return nil, ErrInvalidQuantityBounds
+		}
+
+		// Stripe bills every recurring item of a subscription together
+		if price.Recurring != nil {
+			if interval != nil && (interval.Interval != price.Recurring.Interval || interval.IntervalCount != price.Recurring.IntervalCount) {
+				return nil, ErrMixedBillingIntervals
+			}
+			interval = price.Recurring
+		}
+		if len(lines) > 0 && lines[0].price.Currency != price.Currency {
+			return nil, ErrMixedCurrencies
+		}
+
+		lines = append(lines, checkoutLine{price: price, item: item})
+	}
+	return lines, nil
+}
+
+// cartPrice returns the price of a cart item, the product default price when the item has no price
+func (s *StripeService) cartPrice(ctx context.Context, item types.CheckoutItem) (*stripe.Price, error) {
+	if item.PriceId == "" {
+		// Only the configured products can be sold
+		if !slices.Contains(s.settings.Products, item.ProductId) {
+			return nil, ErrUnknownProduct
+		}
+		productData, err := s.GetProduct(ctx, item.ProductId)
+		if err != nil {
+			return nil, err
+		}
+		if productData.DefaultPrice == nil {
+			return nil, ErrorGettingPrice
+		}
+		return productData.DefaultPrice, nil
+	}
+
+	price, err := s.GetPrice(ctx, item.PriceId)
+	if err != nil {
+		return nil, err
+	}
+	if !price.Active || price.Product == nil {
+		return nil, ErrPriceNotInProduct
+	}
+	if item.ProductId != "" && price.Product.ID != item.ProductId {
+		return nil, ErrPriceNotInProduct
+	}
+	if !slices.Contains(s.settings.Products, price.Product.ID) {
+		return nil, ErrUnknownProduct
+	}
+	return price, nil
+}
+
+// lineItemParams builds the Stripe line items of a cart
+func lineItemParams(lines []checkoutLine) []*stripe.CheckoutSessionLineItemParams {
+	params := make([]*stripe.CheckoutSessionLineItemParams, 0, len(lines))
+	for _, line := range lines {
+		lineItem := &stripe.CheckoutSessionLineItemParams{
+			Price:    stripe.String(line.price.ID),
+			Quantity: stripe.Int64(line.item.Quantity),
+		}
+		if line.item.MaxQuantity > 0 {
+			lineItem.AdjustableQuantity = &stripe.CheckoutSessionLineItemAdjustableQuantityParams{
+				Enabled: stripe.Bool(true),
+				Minimum: stripe.Int64(line.item.MinQuantity),
+				Maximum: stripe.Int64(line.item.MaxQuantity),
+			}
+		}
+		params = append(params, lineItem)
+	}
+	return params
+}
+
+// cartProductIds returns the products of a cart
+func cartProductIds(lines []checkoutLine) []string {
+	productIds := make([]string, 0, len(lines))
+	for _, line := range lines {
+		productIds = append(productIds, line.price.Product.ID)
+	}
+	return productIds
+}
+
+// cartAmount returns the amount of a cart before discounts, in the smallest unit of its currency
+func cartAmount(lines []checkoutLine) (int64, stripe.Currency) {
+	var amount int64
+	for _, line := range lines {
+		amount += line.price.UnitAmount * line.item.Quantity
+	}
+	return amount, lines[0].price.Currency
+}
+
+// sessionItems returns every line item of a completed checkout, with the quantities chosen by the user
+func (s *StripeService) sessionItems(ctx context.Context, sessionId string) ([]models.ItemInSubscription, error) {
+	params := &stripe.CheckoutSessionListLineItemsParams{
+		Session: stripe.String(sessionId),
+	}
+	params.Limit = stripe.Int64(100)
+	ctx, done := startStripeCall(ctx, "ListCheckoutLineItems")
+	params.Context = ctx
+	result := s.client(ctx).CheckoutSessions.ListLineItems(params)
+	var items []models.ItemInSubscription
+	for result.Next() {
+		lineItem := result.LineItem()
+		item := models.ItemInSubscription{
+			Quantity: lineItem.Quantity,
+			Amount:   float32(lineItem.AmountTotal) / 100,
+			Currency: string(lineItem.Currency),
+		}
+		if lineItem.Price != nil {
+			item.PriceId = lineItem.Price.ID
+			item.Recurring = lineItem.Price.Recurring != nil
+			if lineItem.Price.Product != nil {
+				item.ProductId = lineItem.Price.Product.ID
+			}
+		}
+		items = append(items, item)
+	}
+	done(result.Err())
+
+	if result.Err() != nil {
+		logger.FromContext(ctx).Error("error getting checkout line items", "sessionId", sessionId, "error", result.Err())
+		return nil, ErrorGettingCheckoutItems
+	}
+	return items, nil
+}
+
+// subscriptionItems returns the recurring items of a subscription, followed by the one-time items bought with it
+func subscriptionItems(subscription *stripe.Subscription, previous []models.ItemInSubscription) []models.ItemInSubscription {
+	var items []models.ItemInSubscription
+	if subscription.Items != nil {
+		for _, subscriptionItem := range subscription.Items.Data {
+			item := models.ItemInSubscription{
+				Quantity:  subscriptionItem.Quantity,
+				Recurring: true,
+			}
+			if price := subscriptionItem.Price; price != nil {
+				item.PriceId = price.ID
+				item.Amount = float32(price.UnitAmount*subscriptionItem.Quantity) / 100
+				item.Currency = string(price.Currency)
+				if price.Product != nil {
+					item.ProductId = price.Product.ID
+				}
+			}
+			items = append(items, item)
+		}
+	}
+	for _, item := range previous {
+		if !item.Recurring {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,191 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"process-payments/internal/logger"
+	"sync"
+	"time"
+
+	"github.com/stripe/stripe-go/v82"
+)
+
+// Handling catalog errors
+var (
+	ErrorListingPrices = errors.New("error listing prices")
+)
+
+// catalogCacheTTL is how long the products and prices of the catalog are reused, product and price webhooks clear them sooner
+const catalogCacheTTL = 5 * time.Minute
+
+// catalogEntry is an active sold product with its active prices, as listed by Stripe
+type catalogEntry struct {
+	product *stripe.Product
+	prices  []*stripe.Price
+}
+
+// catalogCache keeps the catalog entries, the Stripe API quota is shared with checkouts and webhooks
+type catalogCache struct {
+	mu        sync.Mutex
+	entries   []catalogEntry
+	expiresAt time.Time
+}
+
+// Catalog is the list of sold products with the prices of a country
+type Catalog struct {
+	Country string `json:"country"`
+	// Region and Currency are empty when the country has no regional prices
+	Region   string           `json:"region"`
+	Currency string           `json:"currency"`
+	Products []CatalogProduct `json:"products"`
+}
+
+// CatalogProduct is a sold product with every price a checkout can use
+type CatalogProduct struct {
+	Id          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// DefaultPriceId is the price used by checkouts without a price
+	DefaultPriceId string         `json:"defaultPriceId"`
+	Prices         []CatalogPrice `json:"prices"`
+}
+
+// CatalogPrice is an active price of a product, the amount is in the smallest currency unit
+type CatalogPrice struct {
+	Id         string `json:"id"`
+	Nickname   string `json:"nickname"`
+	LookupKey  string `json:"lookupKey"`
+	Currency   string `json:"currency"`
+	UnitAmount int64  `json:"unitAmount"`
+	// Interval and IntervalCount are empty for one-time prices, such as month and 3 for a quarterly price
+	Interval      string `json:"interval"`
+	IntervalCount int64  `json:"intervalCount"`
+}
+
+// GetCatalog returns the configured products with their active prices, in the order of the configuration.
+// In the region of country, prices are replaced by their regional prices. The regional prices of other regions are never listed.
+func (s *StripeService) GetCatalog(ctx context.Context, country string) (*Catalog, error) {
+	catalog := &Catalog{
+		Country:  country,
+		Products: make([]CatalogProduct, 0, len(s.settings.Products)),
+	}
+	region := s.pricingRegion(country)
+	if region != nil {
+		catalog.Region = region.Name
+		catalog.Currency = region.Currency
+	}
+
+	entries, err := s.catalogEntries(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		productData, prices := entry.product, entry.prices
+		product := CatalogProduct{
+			Id:          productData.ID,
+			Name:        productData.Name,
+			Description: productData.Description,
+			Prices:      make([]CatalogPrice, 0, len(prices)),
+		}
+		if productData.DefaultPrice != nil {
+			product.DefaultPriceId = localizePrice(ctx, region, productData.DefaultPrice, prices).ID
+		}
+		listed := make(map[string]bool, len(prices))
+		for _, price := range prices {
+			// Regional prices are listed in place of the prices they replace
+			if s.reservedPrice(nil, price.ID) {
+				continue
+			}
+			price = localizePrice(ctx, region, price, prices)
+			if listed[price.ID] {
+				continue
+			}
+			listed[price.ID] = true
+			product.Prices = append(product.Prices, catalogPrice(price))
+		}
+		catalog.Products = append(catalog.Products, product)
+	}
+	return catalog, nil
+}
+
+// catalogEntries returns the active configured products with their prices, from the cache while it is fresh.
+// Concurrent requests wait for a single refresh instead of all calling Stripe.
+func (s *StripeService) catalogEntries(ctx context.Context) ([]catalogEntry, error) {
+	s.catalog.mu.Lock()
+	defer s.catalog.mu.Unlock()
+
+	if s.catalog.entries != nil && time.Now().Before(s.catalog.expiresAt) {
+		return s.catalog.entries, nil
+	}
+
+	entries := make([]catalogEntry, 0, len(s.settings.Products))
+	for _, productId := range s.settings.Products {
+		productData, err := s.GetProduct(ctx, productId)
+		if err != nil {
+			return nil, err
+		}
+		if !productData.Active {
+			continue
+		}
+
+		prices, err := s.ListPrices(ctx, productId)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, catalogEntry{product: productData, prices: prices})
+	}
+	s.catalog.entries, s.catalog.expiresAt = entries, time.Now().Add(catalogCacheTTL)
+	return entries, nil
+}
+
+// invalidateCatalog drops the cached catalog, the next request lists the products and prices again
+func (s *StripeService) invalidateCatalog() {
+	s.catalog.mu.Lock()
+	defer s.catalog.mu.Unlock()
+	s.catalog.entries = nil
+}
+
+// ListPrices returns the active prices of a product
+func (s *StripeService) ListPrices(ctx context.Context, productId string) ([]*stripe.Price, error) {
+	params := &stripe.PriceListParams{
+		Product: stripe.String(productId),
+		Active:  stripe.Bool(true),
+	}
+	params.Limit = stripe.Int64(100)
+	ctx, done := startStripeCall(ctx, "ListPrices")
+	params.Context = ctx
+	result := s.client(ctx).Prices.List(params)
+	var prices []*stripe.Price
+	for result.Next() {
+		prices = append(prices, result.Price())
+	}
+	done(result.Err())
+
+	if result.Err() != nil {
+		logger.FromContext(ctx).Error("error listing prices", "productId", productId, "error", result.Err())
+		return nil, ErrorListingPrices
+	}
+	return prices, nil
+}
+
+// catalogPrice converts a Stripe price for the catalog
+func catalogPrice(price *stripe.Price) CatalogPrice {
+	interval, intervalCount := priceInterval(price)
+	return CatalogPrice{
+		Id:            price.ID,
+		Nickname:      price.Nickname,
+		LookupKey:     price.LookupKey,
+		Currency:      string(price.Currency),
+		UnitAmount:    price.UnitAmount,
+		Interval:      interval,
+		IntervalCount: intervalCount,
+	}
+}
+
+// priceInterval returns the billing interval of a price, empty for one-time prices
+func priceInterval(price *stripe.Price) (string, int64) {
+	if price == nil || price.Recurring == nil {
+		return "", 0
+	}
+	return string(price.Recurring.Interval), price.Recurring.IntervalCount
+}
@@ -0,0 +1,155 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"process-payments/internal/logger"
+	"process-payments/internal/repository"
+	"strings"
+
+	"github.com/stripe/stripe-go/v82"
+)
+
+// Checkout UI modes
+const (
+	// CheckoutUIHosted redirects the user to the payment page hosted by Stripe, the default
+	CheckoutUIHosted = "hosted"
+	// CheckoutUIEmbedded mounts the payment form inside our app with the client secret of the session
+	CheckoutUIEmbedded = "embedded"
+)
+
+// CheckoutSessionIdPlaceholder is replaced by Stripe with the session ID in the return URL
+const CheckoutSessionIdPlaceholder = "{CHECKOUT_SESSION_ID}"
+
+// Handling checkout session errors
+var (
+	ErrInvalidUIMode           = errors.New("uiMode must be hosted or embedded")
+	ErrInvalidReturnURL        = errors.New("return URL of an embedded checkout must hold " + CheckoutSessionIdPlaceholder)
+	ErrCheckoutSessionNotFound = errors.New("checkout session not found")
+	ErrGettingCheckoutSession  = errors.New("error getting checkout session")
+	ErrCheckingFulfillment     = errors.New("error checking checkout fulfillment")
+	ErrCheckoutNotComplete     = errors.New("checkout session is not complete")
+)
+
+// CheckoutStatus is the state of a checkout session, polled by the client when the user comes back from the payment
+type CheckoutStatus struct {
+	SessionId string `json:"sessionId"`
+	// Status is open, complete or expired
+	Status string `json:"status"`
+	// PaymentStatus is paid, unpaid or no_payment_required
+	PaymentStatus string `json:"paymentStatus"`
+	// Fulfilled tells whether the subscription or purchase of the checkout is recorded, the user has access once it is
+	Fulfilled bool `json:"fulfilled"`
+	// SubscriptionId is the ID of the recorded subscription or purchase
+	SubscriptionId string `json:"subscriptionId,omitempty"`
+}
+
+// applyUIMode sets where the user lands after the payment: the success and cancel URLs of the hosted page,
+// or the return URL of the embedded form
+func applyUIMode(checkoutParams *stripe.CheckoutSessionParams, uiMode, successURL, cancelURL, returnURL string) error {
+	switch uiMode {
+	case "", CheckoutUIHosted:
+		checkoutParams.SuccessURL = stripe.String(successURL)
+		checkoutParams.CancelURL = stripe.String(cancelURL)
+	case CheckoutUIEmbedded:
+		if !strings.Contains(returnURL, CheckoutSessionIdPlaceholder) {
+			return ErrInvalidReturnURL
+		}
+		checkoutParams.UIMode = stripe.String(string(stripe.CheckoutSessionUIModeEmbedded))
+		checkoutParams.ReturnURL = stripe.String(returnURL)
+	default:
+		return ErrInvalidUIMode
+	}
+	return nil
+}
+
+// RetrieveCheckoutSession returns a checkout session of a user, ErrCheckoutSessionNotFound when it belongs to someone else
+func (s *StripeService) RetrieveCheckoutSession(ctx context.Context, userId, sessionId string) (*stripe.CheckoutSession, error) {
+	params := &stripe.CheckoutSessionParams{}
+	ctx, done := startStripeCall(ctx, "GetCheckoutSession")
+	params.Context = ctx
+	sessionData, err := s.client(ctx).CheckoutSessions.Get(sessionId, params)
+	done(err)
+
+	var stripeErr *stripe.Error
+	if errors.As(err, &stripeErr) && stripeErr.HTTPStatusCode == 404 {
+		return nil, ErrCheckoutSessionNotFound
+	}
+	if err != nil {
+		logger.FromContext(ctx).Error("error getting checkout session", "sessionId", sessionId, "error", err)
+		return nil, ErrGettingCheckoutSession
+	}
+	// Sessions of other users are reported as missing, their IDs must not be probed
+	if sessionData.ClientReferenceID != userId {
+		return nil, ErrCheckoutSessionNotFound
+	}
+	return sessionData, nil
+}
+
+// GetCheckoutStatus returns the state of a checkout session of a user and whether it was fulfilled
+func (s *StripeService) GetCheckoutStatus(ctx context.Context, userId, sessionId string) (*CheckoutStatus, error) {
+	sessionData, err := s.RetrieveCheckoutSession(ctx, userId, sessionId)
+	if err != nil {
+		return nil, err
+	}
+	return s.checkoutStatus(ctx, sessionData)
+}
+
+// FulfillCheckout records the subscription or purchase of a completed checkout of a user when the webhook didn't yet,
+// so that the user has access as soon as the payment page sends them back
+func (s *StripeService) FulfillCheckout(ctx context.Context, userId, sessionId string) (*CheckoutStatus, error) {
+	sessionData, err := s.RetrieveCheckoutSession(ctx, userId, sessionId)
+	if err != nil {
+		return nil, err
+	}
+	if sessionData.Status != stripe.CheckoutSessionStatusComplete {
+		return nil, ErrCheckoutNotComplete
+	}
+
+	status, err := s.checkoutStatus(ctx, sessionData)
+	if err != nil || status.Fulfilled {
+		return status, err
+	}
+	err = s.fulfillCheckout(ctx, *sessionData)
+	if err != nil {
+		return nil, err
+	}
+	return s.checkoutStatus(ctx, sessionData)
+}
+
+// checkoutStatus returns the state of a checkout session and whether it was fulfilled
+func (s *StripeService) checkoutStatus(ctx context.Context, sessionData *stripe.CheckoutSession) (*CheckoutStatus, error) {
+	status := &CheckoutStatus{
+		SessionId:     sessionData.ID,
+		Status:        string(sessionData.Status),
+		PaymentStatus: string(sessionData.PaymentStatus),
+	}
+
+	recordId := checkoutRecordId(*sessionData)
+	if recordId == "" {
+		return status, nil
+	}
+	_, err := s.repo.PaymentCollection.Get(ctx, recordId)
+	if errors.Is(err, repository.ErrSubscriptionNotFound) {
+		return status, nil
+	}
+	if err != nil {
+		logger.FromContext(ctx).Error("error getting subscription", "subscriptionId", recordId, "error", err)
+		return nil, ErrCheckingFulfillment
+	}
+	status.Fulfilled = true
+	status.SubscriptionId = recordId
+	return status, nil
+}
+
+// checkoutRecordId returns the ID a checkout is recorded under: subscriptions under their ID, one-time purchases under the session ID.
+// It is empty for subscription checkouts that did not create their subscription yet.
+func checkoutRecordId(sessionData stripe.CheckoutSession) string {
+	if sessionData.Mode != stripe.CheckoutSessionModeSubscription {
+		return sessionData.ID
+	}
+	if sessionData.Subscription == nil {
+		return ""
+	}
+	return sessionData.Subscription.ID
+}
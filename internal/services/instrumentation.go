@@ -0,0 +1,21 @@
+package services
+
+import (
+	"context"
+	"process-payments/internal/metrics"
+	"process-payments/internal/tracing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// startStripeCall starts a span for a Stripe API call.
+// The returned function ends the span and records the call latency and error metrics.
+func startStripeCall(ctx context.Context, operation string) (context.Context, func(error)) {
+	start := time.Now()
+	ctx, span := tracing.Start(ctx, "stripe."+operation, attribute.String("stripe.operation", operation))
+	return ctx, func(err error) {
+		metrics.ObserveStripeCall(operation, start, err)
+		tracing.End(span, err)
+	}
+}
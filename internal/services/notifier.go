@@ -0,0 +1,137 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"process-payments/internal/logger"
+	"process-payments/internal/models"
+	"process-payments/internal/secrets"
+	"time"
+)
+
+// Notifier tells users about billing events that need their attention, such as an ending trial
+type Notifier interface {
+	TrialWillEnd(ctx context.Context, subscription *models.Subscription, trialEndsAt time.Time) error
+	// PaymentFailed is sent when the delayed payment of a checkout, such as a SEPA Debit, failed
+	PaymentFailed(ctx context.Context, subscription *models.Subscription) error
+}
+
+// Notification types
+const (
+	NotificationTrialWillEnd  = "trial_will_end"
+	NotificationPaymentFailed = "payment_failed"
+)
+
+// NotificationSignatureHeader holds the hex HMAC-SHA256 of the body of the notifications, keyed with the notification secret
+const NotificationSignatureHeader = "Notification-Signature"
+
+// Handling notification errors
+var (
+	ErrSendingNotification = errors.New("error sending notification")
+)
+
+// LogNotifier only logs the notifications, it is used when no notification webhook is configured
+type LogNotifier struct{}
+
+func (LogNotifier) TrialWillEnd(ctx context.Context, subscription *models.Subscription, trialEndsAt time.Time) error {
+	logger.FromContext(ctx).Info("trial will end", "userId", subscription.UserId, "subscriptionId", subscription.SubscriptionID, "trialEndsAt", trialEndsAt)
+	return nil
+}
+
+func (LogNotifier) PaymentFailed(ctx context.Context, subscription *models.Subscription) error {
+	logger.FromContext(ctx).Info("payment failed", "userId", subscription.UserId, "subscriptionId", subscription.SubscriptionID)
+	return nil
+}
+
+// Notification is the JSON body posted by the WebhookNotifier, dates are in milliseconds
+type Notification struct {
+	Type           string `json:"type"`
+	UserId         string `json:"userId"`
+	Email          string `json:"email"`
+	Name           string `json:"name"`
+	SubscriptionId string `json:"subscriptionId"`
+	ProductId      string `json:"productId"`
+	// TrialEndsAt is set for trial_will_end notifications
+	TrialEndsAt int64 `json:"trialEndsAt,omitempty"`
+	SentAt      int64 `json:"sentAt"`
+}
+
+// WebhookNotifier posts the notifications to the messaging service that emails or pushes them to the users.
+// Bodies are signed in the Notification-Signature header when the NOTIFICATION_WEBHOOK_SECRET secret is set.
+type WebhookNotifier struct {
+	url     string
+	secrets secrets.Provider
+	client  *http.Client
+}
+
+// NewWebhookNotifier creates a notifier posting to url
+func NewWebhookNotifier(url string, secretProvider secrets.Provider) *WebhookNotifier {
+	return &WebhookNotifier{
+		url:     url,
+		secrets: secretProvider,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (n *WebhookNotifier) TrialWillEnd(ctx context.Context, subscription *models.Subscription, trialEndsAt time.Time) error {
+	notification := newNotification(NotificationTrialWillEnd, subscription)
+	notification.TrialEndsAt = trialEndsAt.UnixMilli()
+	return n.send(ctx, notification)
+}
+
+func (n *WebhookNotifier) PaymentFailed(ctx context.Context, subscription *models.Subscription) error {
+	return n.send(ctx, newNotification(NotificationPaymentFailed, subscription))
+}
+
+// newNotification returns a notification about a subscription
+func newNotification(notificationType string, subscription *models.Subscription) Notification {
+	return Notification{
+		Type:           notificationType,
+		UserId:         subscription.UserId,
+		Email:          subscription.User.Email,
+		Name:           subscription.User.Name,
+		SubscriptionId: subscription.SubscriptionID,
+		ProductId:      subscription.Plan.ProductId,
+		SentAt:         time.Now().UnixMilli(),
+	}
+}
+
+// send posts a notification, any answer but 2xx is an error
+func (n *WebhookNotifier) send(ctx context.Context, notification Notification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrSendingNotification, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrSendingNotification, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	secret, err := n.secrets.Get(ctx, secrets.NotificationWebhookSecret)
+	if err != nil && !errors.Is(err, secrets.ErrSecretNotFound) {
+		return fmt.Errorf("%w: %v", ErrSendingNotification, err)
+	}
+	if secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		req.Header.Set(NotificationSignatureHeader, hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	res, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrSendingNotification, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("%w: %s answered %d", ErrSendingNotification, notification.Type, res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,381 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"process-payments/internal/logger"
+	"process-payments/internal/models"
+	"slices"
+	"time"
+
+	"github.com/stripe/stripe-go/v82"
+)
+
+// PlanChangeTiming tells when a plan change takes effect
+type PlanChangeTiming string
+
+const (
+	// PlanChangeNow switches the plan right away, prorated following the product pair proration behavior
+	PlanChangeNow PlanChangeTiming = "now"
+	// PlanChangePeriodEnd switches the plan at the end of the current period through a subscription schedule, without proration
+	PlanChangePeriodEnd PlanChangeTiming = "period_end"
+)
+
+// Stripe proration behaviors
+const (
+	ProrationCreateProrations = "create_prorations"
+	ProrationAlwaysInvoice    = "always_invoice"
+	ProrationNone             = "none"
+)
+
+// ProductPair is a change from the From product to the To product, both may be the same product
+type ProductPair struct {
+	From string
+	To   string
+}
+
+// PlanChange describes a plan change requested by a user
+type PlanChange struct {
+	UserId         string
+	SubscriptionId string
+	// ItemId or ProductId names the subscription item to change, the other items of the subscription are kept
+	ItemId    string
+	ProductId string
+	PriceId   string
+	// Quantity keeps the current quantity when lower than 1
+	Quantity int64
+	Timing   PlanChangeTiming
+}
+
+// PlanChangePreview is what a plan change would cost, amounts are in the smallest currency unit
+type PlanChangePreview struct {
+	Currency string `json:"currency"`
+	// AmountDue is the amount of the next invoice after the change
+	AmountDue int64 `json:"amountDue"`
+	// ProrationAmount is the part of AmountDue coming from prorations, negative for a credit
+	ProrationAmount   int64  `json:"prorationAmount"`
+	ProrationBehavior string `json:"prorationBehavior"`
+	// EffectiveAt is when the change takes effect, in milliseconds
+	EffectiveAt int64 `json:"effectiveAt"`
+}
+
+// Plan change errors
+var (
+	ErrInvalidPlanChangeTiming = errors.New("timing must be now or period_end")
+	ErrPriceNotRecurring       = errors.New("price is not an active recurring price of a sold product")
+	ErrSamePlan                = errors.New("subscription is already on this plan")
+	ErrPreviewingPlanChange    = errors.New("error previewing plan change")
+	ErrChangingPlan            = errors.New("error changing plan")
+	ErrSchedulingPlanChange    = errors.New("error scheduling plan change")
+	ErrSubscriptionHasNoItem   = errors.New("subscription has no item to change")
+	ErrPlanChangeItemRequired  = errors.New("itemId or productId is required")
+	ErrPlanChangeItemNotFound  = errors.New("subscription has no such item")
+	ErrPlanChangeItemAmbiguous = errors.New("subscription has several items of the product, itemId is required")
+)
+
+// prorationBehavior returns the proration behavior configured for a change between two products
+func (s *StripeService) prorationBehavior(from, to string) string {
+	if behavior, ok := s.settings.ProrationBehaviors[ProductPair{From: from, To: to}]; ok {
+		return behavior
+	}
+	if s.settings.DefaultProrationBehavior != "" {
+		return s.settings.DefaultProrationBehavior
+	}
+	return ProrationCreateProrations
+}
+
+// planChangeTarget loads what a plan change needs: the owned Stripe subscription, the item to change and the new price
+func (s *StripeService) planChangeTarget(ctx context.Context, change PlanChange) (*stripe.Subscription, *stripe.SubscriptionItem, *stripe.Price, error) {
+	switch change.Timing {
+	case PlanChangeNow, PlanChangePeriodEnd:
+	default:
+		return nil, nil, nil, ErrInvalidPlanChangeTiming
+	}
+
+	_, err := s.ownedSubscription(ctx, change.UserId, change.SubscriptionId)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	subscriptionData, err := s.GetSubscription(ctx, change.SubscriptionId)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	item, err := planChangeItem(subscriptionData, change)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	priceData, err := s.GetPrice(ctx, change.PriceId)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if !priceData.Active || priceData.Recurring == nil || priceData.Product == nil || !slices.Contains(s.settings.Products, priceData.Product.ID) {
+		return nil, nil, nil, ErrPriceNotRecurring
+	}
+	if item.Price.ID == priceData.ID && (change.Quantity < 1 || change.Quantity == item.Quantity) {
+		return nil, nil, nil, ErrSamePlan
+	}
+	// Regional prices are only sold in their region, as on checkout. The region is the one of the billing address of the customer.
+	if item.Price.ID != priceData.ID && s.reservedPrice(nil, priceData.ID) {
+		customerData, err := s.GetCustomer(ctx, subscriptionData.Customer.ID)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		region := s.pricingRegion(resolveCountry("", "", []*stripe.Customer{customerData}))
+		if s.reservedPrice(region, priceData.ID) {
+			return nil, nil, nil, ErrPriceNotInRegion
+		}
+	}
+
+	return subscriptionData, item, priceData, nil
+}
+
+// planChangeItem returns the subscription item named by the change, by item ID or by product
+func planChangeItem(subscriptionData *stripe.Subscription, change PlanChange) (*stripe.SubscriptionItem, error) {
+	if change.ItemId == "" && change.ProductId == "" {
+		return nil, ErrPlanChangeItemRequired
+	}
+	if subscriptionData.Items == nil || len(subscriptionData.Items.Data) == 0 {
+		return nil, ErrSubscriptionHasNoItem
+	}
+
+	var found *stripe.SubscriptionItem
+	for _, item := range subscriptionData.Items.Data {
+		if change.ItemId != "" {
+			if item.ID == change.ItemId {
+				return item, nil
+			}
+			continue
+		}
+		if item.Price == nil || item.Price.Product == nil || item.Price.Product.ID != change.ProductId {
+			continue
+		}
+		if found != nil {
+			return nil, ErrPlanChangeItemAmbiguous
+		}
+		found = item
+	}
+	if found == nil {
+		return nil, ErrPlanChangeItemNotFound
+	}
+	return found, nil
+}
+
+// PreviewPlanChange previews the next invoice of a subscription after a plan change
+func (s *StripeService) PreviewPlanChange(ctx context.Context, change PlanChange) (*PlanChangePreview, error) {
+	subscriptionData, item, priceData, err := s.planChangeTarget(ctx, change)
+	if err != nil {
+		return nil, err
+	}
+	quantity := change.Quantity
+	if quantity < 1 {
+		quantity = item.Quantity
+	}
+
+	prorationBehavior := s.prorationBehavior(item.Price.Product.ID, priceData.Product.ID)
+	effectiveAt := time.Now().Unix()
+	if change.Timing == PlanChangePeriodEnd {
+		prorationBehavior = ProrationNone
+		effectiveAt = item.CurrentPeriodEnd
+	}
+
+	params := &stripe.InvoiceCreatePreviewParams{
+		Customer:     stripe.String(subscriptionData.Customer.ID),
+		Subscription: stripe.String(subscriptionData.ID),
+		SubscriptionDetails: &stripe.InvoiceCreatePreviewSubscriptionDetailsParams{
+			Items: []*stripe.InvoiceCreatePreviewSubscriptionDetailsItemParams{
+				{
+					ID:       stripe.String(item.ID),
+					Price:    stripe.String(priceData.ID),
+					Quantity: stripe.Int64(quantity),
+				},
+			},
+			ProrationBehavior: stripe.String(prorationBehavior),
+			ProrationDate:     stripe.Int64(effectiveAt),
+		},
+	}
+	ctx, done := startStripeCall(ctx, "CreateInvoicePreview")
+	params.Context = ctx
+	invoiceData, err := s.client(ctx).Invoices.CreatePreview(params)
+	done(err)
+
+	if err != nil {
+		logger.FromContext(ctx).Error("error previewing plan change", "subscriptionId", change.SubscriptionId, "priceId", change.PriceId, "error", err)
+		return nil, ErrPreviewingPlanChange
+	}
+
+	preview := &PlanChangePreview{
+		Currency:          string(invoiceData.Currency),
+		AmountDue:         invoiceData.AmountDue,
+		ProrationBehavior: prorationBehavior,
+		EffectiveAt:       effectiveAt * 1000,
+	}
+	if invoiceData.Lines != nil {
+		for _, line := range invoiceData.Lines.Data {
+			if line.Parent != nil && line.Parent.SubscriptionItemDetails != nil && line.Parent.SubscriptionItemDetails.Proration {
+				preview.ProrationAmount += line.Amount
+			}
+		}
+	}
+
+	return preview, nil
+}
+
+// ChangePlan applies a plan change now or at the end of the current period, and records it on the subscription
+func (s *StripeService) ChangePlan(ctx context.Context, change PlanChange) (*models.Subscription, error) {
+	ctx = logger.With(ctx, "subscriptionId", change.SubscriptionId)
+	log := logger.FromContext(ctx)
+
+	subscriptionData, item, priceData, err := s.planChangeTarget(ctx, change)
+	if err != nil {
+		return nil, err
+	}
+	quantity := change.Quantity
+	if quantity < 1 {
+		quantity = item.Quantity
+	}
+
+	subscriptionModel, err := s.ownedSubscription(ctx, change.UserId, change.SubscriptionId)
+	if err != nil {
+		return nil, err
+	}
+
+	if change.Timing == PlanChangePeriodEnd {
+		scheduleId, err := s.schedulePlanChange(ctx, subscriptionData, item, priceData.ID, quantity)
+		if err != nil {
+			return nil, err
+		}
+		subscriptionModel.Plan.ScheduledChange = &models.ScheduledPlanChange{
+			ScheduleId:  scheduleId,
+			ProductId:   priceData.Product.ID,
+			PriceId:     priceData.ID,
+			EffectiveAt: item.CurrentPeriodEnd * 1000,
+		}
+	} else {
+		params := &stripe.SubscriptionParams{
+			Items: []*stripe.SubscriptionItemsParams{
+				{
+					ID:       stripe.String(item.ID),
+					Price:    stripe.String(priceData.ID),
+					Quantity: stripe.Int64(quantity),
+				},
+			},
+			ProrationBehavior: stripe.String(s.prorationBehavior(item.Price.Product.ID, priceData.Product.ID)),
+		}
+		ctx, done := startStripeCall(ctx, "UpdateSubscription")
+		params.Context = ctx
+		_, err := s.client(ctx).Subscriptions.Update(subscriptionData.ID, params)
+		done(err)
+		if err != nil {
+			log.Error("error changing plan", "priceId", priceData.ID, "error", err)
+			return nil, ErrChangingPlan
+		}
+		// The amounts are updated by the customer.subscription.updated webhook, with the new invoice
+		if item.Price.ID == subscriptionModel.Plan.PriceId {
+			subscriptionModel.Plan.ProductId = priceData.Product.ID
+			subscriptionModel.Plan.PriceId = priceData.ID
+			subscriptionModel.Plan.Interval, subscriptionModel.Plan.IntervalCount = priceInterval(priceData)
+			subscriptionModel.Plan.ScheduledChange = nil
+		}
+		for i := range subscriptionModel.Items {
+			if subscriptionModel.Items[i].Recurring && subscriptionModel.Items[i].PriceId == item.Price.ID {
+				subscriptionModel.Items[i].ProductId = priceData.Product.ID
+				subscriptionModel.Items[i].PriceId = priceData.ID
+				subscriptionModel.Items[i].Quantity = quantity
+				break
+			}
+		}
+	}
+
+	subscriptionModel.UpdatedAt = time.Now().UnixMilli()
+	err = s.repo.PaymentCollection.Update(ctx, subscriptionModel)
+	if err != nil {
+		log.Error("error updating payment", "error", err)
+		return nil, err
+	}
+
+	return subscriptionModel, nil
+}
+
+// schedulePlanChange moves an item of a subscription to priceId at the end of its current period with a subscription schedule.
+// The other items are kept in both phases. The schedule is released once the new phase starts, the subscription then renews normally.
+func (s *StripeService) schedulePlanChange(ctx context.Context, subscriptionData *stripe.Subscription, item *stripe.SubscriptionItem, priceId string, quantity int64) (string, error) {
+	log := logger.FromContext(ctx)
+
+	var schedule *stripe.SubscriptionSchedule
+	if subscriptionData.Schedule != nil {
+		params := &stripe.SubscriptionScheduleParams{}
+		callCtx, done := startStripeCall(ctx, "GetSubscriptionSchedule")
+		params.Context = callCtx
+		existing, err := s.client(ctx).SubscriptionSchedules.Get(subscriptionData.Schedule.ID, params)
+		done(err)
+		if err != nil {
+			log.Error("error getting subscription schedule", "scheduleId", subscriptionData.Schedule.ID, "error", err)
+			return "", ErrSchedulingPlanChange
+		}
+		schedule = existing
+	} else {
+		params := &stripe.SubscriptionScheduleParams{
+			FromSubscription: stripe.String(subscriptionData.ID),
+		}
+		callCtx, done := startStripeCall(ctx, "CreateSubscriptionSchedule")
+		params.Context = callCtx
+		created, err := s.client(ctx).SubscriptionSchedules.New(params)
+		done(err)
+		if err != nil {
+			log.Error("error creating subscription schedule", "error", err)
+			return "", ErrSchedulingPlanChange
+		}
+		schedule = created
+	}
+
+	// The current phase must keep its start date
+	startDate := item.CurrentPeriodStart
+	if schedule.CurrentPhase != nil {
+		startDate = schedule.CurrentPhase.StartDate
+	}
+
+	params := &stripe.SubscriptionScheduleParams{
+		EndBehavior: stripe.String(string(stripe.SubscriptionScheduleEndBehaviorRelease)),
+		Phases: []*stripe.SubscriptionSchedulePhaseParams{
+			{
+				Items:     phaseItems(subscriptionData.Items.Data, nil, "", 0),
+				StartDate: stripe.Int64(startDate),
+				EndDate:   stripe.Int64(item.CurrentPeriodEnd),
+			},
+			{
+				Items:             phaseItems(subscriptionData.Items.Data, item, priceId, quantity),
+				ProrationBehavior: stripe.String(ProrationNone),
+			},
+		},
+	}
+	ctx, done := startStripeCall(ctx, "UpdateSubscriptionSchedule")
+	params.Context = ctx
+	_, err := s.client(ctx).SubscriptionSchedules.Update(schedule.ID, params)
+	done(err)
+	if err != nil {
+		log.Error("error scheduling plan change", "scheduleId", schedule.ID, "priceId", priceId, "error", err)
+		return "", ErrSchedulingPlanChange
+	}
+
+	return schedule.ID, nil
+}
+
+// phaseItems returns the items of a schedule phase: the items of the subscription, with changed switched to priceId and quantity.
+// The phases replace the items of the subscription, an item missing from them would be dropped.
+func phaseItems(items []*stripe.SubscriptionItem, changed *stripe.SubscriptionItem, priceId string, quantity int64) []*stripe.SubscriptionSchedulePhaseItemParams {
+	phase := make([]*stripe.SubscriptionSchedulePhaseItemParams, 0, len(items))
+	for _, item := range items {
+		params := &stripe.SubscriptionSchedulePhaseItemParams{
+			Price:    stripe.String(item.Price.ID),
+			Quantity: stripe.Int64(item.Quantity),
+		}
+		if changed != nil && item.ID == changed.ID {
+			params.Price = stripe.String(priceId)
+			params.Quantity = stripe.Int64(quantity)
+		}
+		phase = append(phase, params)
+	}
+	return phase
+}
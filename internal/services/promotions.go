@@ -0,0 +1,190 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"process-payments/internal/logger"
+	"process-payments/internal/models"
+	"slices"
+	"time"
+
+	"github.com/stripe/stripe-go/v82"
+)
+
+// Handling promotion codes errors
+var (
+	ErrorGettingPromotionCode            = errors.New("error getting promotion code")
+	ErrPromotionCodeNotFound             = errors.New("promotion code not found")
+	ErrPromotionCodeInactive             = errors.New("promotion code is no longer active")
+	ErrPromotionCodeExpired              = errors.New("promotion code has expired")
+	ErrPromotionCodeMaxRedemptions       = errors.New("promotion code has reached its maximum number of uses")
+	ErrPromotionCodeNotApplicable        = errors.New("promotion code does not apply to this product")
+	ErrPromotionCodeMinimumAmount        = errors.New("order amount is below the minimum amount of the promotion code")
+	ErrPromotionCodeCustomerRestricted   = errors.New("promotion code is reserved to another customer")
+	ErrPromotionCodeFirstTimeTransaction = errors.New("promotion code is reserved to first purchases")
+)
+
+// Promotion code metadata key of the products letting users type a promotion code on the payment page
+const metadataAllowPromotionCodes = "allow_promotion_codes"
+
+//Promotion codes
+
+// GetPromotionCode retrieves the promotion code with the given customer-facing code from Stripe, preferring an active one.
+// Codes that exist but can't be used anymore are reported with ErrPromotionCodeInactive.
+func (s *StripeService) GetPromotionCode(ctx context.Context, code string) (*stripe.PromotionCode, error) {
+	params := &stripe.PromotionCodeListParams{
+		Code: stripe.String(code),
+	}
+	params.Limit = stripe.Int64(10)
+	params.AddExpand("data.coupon.applies_to")
+	ctx, done := startStripeCall(ctx, "ListPromotionCodes")
+	params.Context = ctx
+	result := s.client(ctx).PromotionCodes.List(params)
+	promotionCodes := result.PromotionCodeList().Data
+	done(result.Err())
+
+	if result.Err() != nil {
+		logger.FromContext(ctx).Error("error getting promotion code", "error", result.Err())
+		return nil, ErrorGettingPromotionCode
+	}
+	if len(promotionCodes) < 1 {
+		return nil, ErrPromotionCodeNotFound
+	}
+
+	for _, promotionCode := range promotionCodes {
+		if promotionCode.Active {
+			return promotionCode, nil
+		}
+	}
+	return nil, ErrPromotionCodeInactive
+}
+
+// validatePromotionCode checks the restrictions of a promotion code against the checkout, so the user gets a clear error
+// instead of a failed session creation. customers are the customers of the user, a code reserved to a customer applies
+// when it is one of them. First purchases are checked by checkFirstPurchase.
+func validatePromotionCode(promotionCode *stripe.PromotionCode, lines []checkoutLine, customers []*stripe.Customer) error {
+	now := time.Now().Unix()
+	coupon := promotionCode.Coupon
+
+	if coupon == nil || !coupon.Valid {
+		return ErrPromotionCodeInactive
+	}
+	if (promotionCode.ExpiresAt > 0 && promotionCode.ExpiresAt <= now) || (coupon.RedeemBy > 0 && coupon.RedeemBy <= now) {
+		return ErrPromotionCodeExpired
+	}
+	if (promotionCode.MaxRedemptions > 0 && promotionCode.TimesRedeemed >= promotionCode.MaxRedemptions) ||
+		(coupon.MaxRedemptions > 0 && coupon.TimesRedeemed >= coupon.MaxRedemptions) {
+		return ErrPromotionCodeMaxRedemptions
+	}
+	// A code restricted to some products applies when one of them is in the cart
+	if coupon.AppliesTo != nil && len(coupon.AppliesTo.Products) > 0 && !slices.ContainsFunc(cartProductIds(lines), func(productId string) bool {
+		return slices.Contains(coupon.AppliesTo.Products, productId)
+	}) {
+		return ErrPromotionCodeNotApplicable
+	}
+	if promotionCode.Customer != nil && !slices.ContainsFunc(customers, func(customer *stripe.Customer) bool {
+		return customer.ID == promotionCode.Customer.ID
+	}) {
+		return ErrPromotionCodeCustomerRestricted
+	}
+
+	if restrictions := promotionCode.Restrictions; restrictions != nil {
+		amount, currency := cartAmount(lines)
+		if restrictions.MinimumAmount > 0 && restrictions.MinimumAmountCurrency == currency && amount < restrictions.MinimumAmount {
+			return ErrPromotionCodeMinimumAmount
+		}
+	}
+
+	return nil
+}
+
+// checkFirstPurchase refuses a code reserved to first purchases when a customer of the user already paid an invoice or a charge.
+// Every customer is checked, a checkout creating a new customer must not make a returning user look new.
+func (s *StripeService) checkFirstPurchase(ctx context.Context, customers []*stripe.Customer) error {
+	for _, customer := range customers {
+		invoiceParams := &stripe.InvoiceListParams{
+			Customer: stripe.String(customer.ID),
+			Status:   stripe.String(string(stripe.InvoiceStatusPaid)),
+		}
+		invoiceParams.Limit = stripe.Int64(1)
+		callCtx, done := startStripeCall(ctx, "ListInvoices")
+		invoiceParams.Context = callCtx
+		invoices := s.client(ctx).Invoices.List(invoiceParams)
+		paidInvoices := invoices.InvoiceList().Data
+		done(invoices.Err())
+		if invoices.Err() != nil {
+			logger.FromContext(ctx).Error("error listing invoices of the customer", "customerId", customer.ID, "error", invoices.Err())
+			return ErrorGettingPromotionCode
+		}
+		if len(paidInvoices) > 0 {
+			return ErrPromotionCodeFirstTimeTransaction
+		}
+
+		// One-time purchases are paid without an invoice
+		chargeParams := &stripe.ChargeListParams{
+			Customer: stripe.String(customer.ID),
+		}
+		chargeParams.Limit = stripe.Int64(10)
+		callCtx, done = startStripeCall(ctx, "ListCharges")
+		chargeParams.Context = callCtx
+		charges := s.client(ctx).Charges.List(chargeParams)
+		customerCharges := charges.ChargeList().Data
+		done(charges.Err())
+		if charges.Err() != nil {
+			logger.FromContext(ctx).Error("error listing charges of the customer", "customerId", customer.ID, "error", charges.Err())
+			return ErrorGettingPromotionCode
+		}
+		if slices.ContainsFunc(customerCharges, func(charge *stripe.Charge) bool {
+			return charge.Status == stripe.ChargeStatusSucceeded
+		}) {
+			return ErrPromotionCodeFirstTimeTransaction
+		}
+	}
+	return nil
+}
+
+// allowPromotionCodes tells whether users can type a promotion code on the payment page of a product
+func (s *StripeService) allowPromotionCodes(product *stripe.Product) bool {
+	if value, ok := product.Metadata[metadataAllowPromotionCodes]; ok {
+		return value == "true"
+	}
+	return s.productSettings(product.ID).AllowPromotionCodes
+}
+
+// discountFromSession returns the discount applied to a completed checkout, nil when there was none.
+// The code and coupon details are best effort, the IDs and amount are always kept.
+func (s *StripeService) discountFromSession(ctx context.Context, checkoutSession stripe.CheckoutSession) *models.DiscountInSubscription {
+	if len(checkoutSession.Discounts) == 0 {
+		return nil
+	}
+	applied := checkoutSession.Discounts[0]
+	discount := &models.DiscountInSubscription{}
+	if checkoutSession.TotalDetails != nil {
+		discount.AmountDiscounted = float32(checkoutSession.TotalDetails.AmountDiscount) / 100
+	}
+
+	coupon := applied.Coupon
+	if applied.PromotionCode != nil {
+		discount.PromotionCodeId = applied.PromotionCode.ID
+		params := &stripe.PromotionCodeParams{}
+		callCtx, done := startStripeCall(ctx, "GetPromotionCode")
+		params.Context = callCtx
+		promotionCode, err := s.client(ctx).PromotionCodes.Get(applied.PromotionCode.ID, params)
+		done(err)
+		if err != nil {
+			logger.FromContext(ctx).Warn("error getting promotion code", "promotionCodeId", applied.PromotionCode.ID, "error", err)
+		} else {
+			discount.Code = promotionCode.Code
+			coupon = promotionCode.Coupon
+		}
+	}
+
+	if coupon != nil {
+		discount.CouponId = coupon.ID
+		discount.PercentOff = coupon.PercentOff
+		discount.AmountOff = float32(coupon.AmountOff) / 100
+		discount.Currency = string(coupon.Currency)
+		discount.Duration = string(coupon.Duration)
+	}
+	return discount
+}
@@ -0,0 +1,157 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"process-payments/internal/logger"
+	"slices"
+	"strings"
+
+	"github.com/stripe/stripe-go/v82"
+)
+
+// Handling regional pricing errors
+var (
+	ErrPriceNotInRegion = errors.New("price is not sold in the country of the customer")
+)
+
+// PricingRegion sells the products at local prices to the customers of some countries
+type PricingRegion struct {
+	Name string
+	// Countries are ISO 3166-1 alpha-2 codes, such as FR
+	Countries []string
+	// Currency picks, among the prices of a product, the one with the same billing interval in this currency
+	Currency string
+	// Prices replaces prices by regional ones, by price ID, such as a cheaper price for purchasing-power parity.
+	// Regional prices are only sold to the customers of the region.
+	Prices map[string]string
+}
+
+// pricingRegion returns the region of a country, nil when the country has no regional prices
+func (s *StripeService) pricingRegion(country string) *PricingRegion {
+	if country == "" {
+		return nil
+	}
+	for i := range s.settings.Regions {
+		if slices.Contains(s.settings.Regions[i].Countries, country) {
+			return &s.settings.Regions[i]
+		}
+	}
+	return nil
+}
+
+// ResolveCountry returns the country prices are picked for, from the first of: the country chosen by the client,
+// the billing address of the Stripe customer of the user and the country of the client IP set by our CDN.
+// It is empty when none is known. The customers are only searched when the client chose no country.
+func (s *StripeService) ResolveCountry(ctx context.Context, userId, country, ipCountry string) string {
+	if country = normalizeCountry(country); country != "" {
+		return country
+	}
+
+	customers, err := s.userCustomers(ctx, userId)
+	if err != nil {
+		logger.FromContext(ctx).Warn("error searching customers of the user", "error", err)
+	}
+	return resolveCountry(country, ipCountry, customers)
+}
+
+// resolveCountry is ResolveCountry with the customers of the user already searched
+func resolveCountry(country, ipCountry string, customers []*stripe.Customer) string {
+	if country = normalizeCountry(country); country != "" {
+		return country
+	}
+	for _, customer := range customers {
+		if customer.Address != nil {
+			if country = normalizeCountry(customer.Address.Country); country != "" {
+				return country
+			}
+		}
+	}
+
+	return normalizeCountry(ipCountry)
+}
+
+// normalizeCountry returns an ISO 3166-1 alpha-2 code in upper case, empty for anything else such as the XX unknown country of CDNs
+func normalizeCountry(country string) string {
+	country = strings.ToUpper(strings.TrimSpace(country))
+	if len(country) != 2 || country[0] < 'A' || country[0] > 'Z' || country[1] < 'A' || country[1] > 'Z' || country == "XX" {
+		return ""
+	}
+	return country
+}
+
+// reservedPrice tells whether a price is a regional price of another region than region
+func (s *StripeService) reservedPrice(region *PricingRegion, priceId string) bool {
+	reserved := false
+	for i := range s.settings.Regions {
+		for _, regionalPriceId := range s.settings.Regions[i].Prices {
+			if regionalPriceId != priceId {
+				continue
+			}
+			if region != nil && region.Name == s.settings.Regions[i].Name {
+				return false
+			}
+			reserved = true
+		}
+	}
+	return reserved
+}
+
+// regionalPrice returns the price sold instead of price in a region, price itself when the region has none
+func (s *StripeService) regionalPrice(ctx context.Context, region *PricingRegion, price *stripe.Price) (*stripe.Price, error) {
+	if s.reservedPrice(region, price.ID) {
+		return nil, ErrPriceNotInRegion
+	}
+	if region == nil {
+		return price, nil
+	}
+	_, mapped := region.Prices[price.ID]
+	if !mapped && (region.Currency == "" || string(price.Currency) == region.Currency) {
+		return price, nil
+	}
+
+	productPrices, err := s.ListPrices(ctx, price.Product.ID)
+	if err != nil {
+		return nil, err
+	}
+	return localizePrice(ctx, region, price, productPrices), nil
+}
+
+// localizePrice picks the price of a region among the active prices of the product: the regional price mapped to price,
+// or the price with the same billing interval in the region currency. Price is kept when there is none or several.
+func localizePrice(ctx context.Context, region *PricingRegion, price *stripe.Price, productPrices []*stripe.Price) *stripe.Price {
+	if region == nil {
+		return price
+	}
+
+	if regionalPriceId, ok := region.Prices[price.ID]; ok {
+		for _, productPrice := range productPrices {
+			if productPrice.ID == regionalPriceId {
+				return productPrice
+			}
+		}
+		logger.FromContext(ctx).Warn("regional price is not an active price of the product", "region", region.Name, "priceId", price.ID, "regionalPriceId", regionalPriceId)
+		return price
+	}
+
+	if region.Currency == "" || string(price.Currency) == region.Currency {
+		return price
+	}
+	interval, intervalCount := priceInterval(price)
+	var localized *stripe.Price
+	for _, productPrice := range productPrices {
+		productInterval, productIntervalCount := priceInterval(productPrice)
+		if string(productPrice.Currency) != region.Currency || productInterval != interval || productIntervalCount != intervalCount {
+			continue
+		}
+		if localized != nil {
+			// Several prices would match, such as the tiers of a plan, only a mapping can tell which one
+			return price
+		}
+		localized = productPrice
+	}
+	if localized == nil {
+		return price
+	}
+	return localized
+}
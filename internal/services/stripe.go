@@ -1,49 +1,105 @@
 package services
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
-	"log"
 	"net/http"
+	"process-payments/internal/logger"
+	"process-payments/internal/metrics"
 	"process-payments/internal/models"
 	"process-payments/internal/repository"
+	"process-payments/internal/secrets"
+	"process-payments/internal/tracing"
 	"process-payments/pkg/types"
 	"slices"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stripe/stripe-go/v82"
-	"github.com/stripe/stripe-go/v82/checkout/session"
-	"github.com/stripe/stripe-go/v82/customer"
-	"github.com/stripe/stripe-go/v82/invoice"
-	"github.com/stripe/stripe-go/v82/product"
-	"github.com/stripe/stripe-go/v82/subscription"
+	"github.com/stripe/stripe-go/v82/client"
 	"github.com/stripe/stripe-go/v82/webhook"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-const TwelveHoursInMilliseconds int64 = 3600 * 12 * 1000
-
 type StripeService struct {
-	stripeSecretKey        string
-	stripeWebhookSecretKey string
-	products               []string
-	isProd                 bool
-	repo                   *repository.Collections
+	secrets  secrets.Provider
+	settings StripeSettings
+	isProd   bool
+	repo     *repository.Collections
+	notifier Notifier
+	catalog  catalogCache
+
+	// api is the Stripe client for apiKey, rebuilt when the secret key is rotated
+	apiMu  sync.Mutex
+	api    *client.API
+	apiKey string
+}
+
+// StripeSettings holds the catalog and billing settings of the StripeService
+type StripeSettings struct {
+	Products []string
+	// TrialDays is the trial length granted on products with the trial metadata and no trial length of their own
+	TrialDays int64
+	// GracePeriod is added to the end of each paid period, invoices sometimes take a while to be processed
+	GracePeriod time.Duration
+	// ProductSettings holds the billing rules of the products that don't use the defaults
+	ProductSettings map[string]ProductSettings
+	// DefaultProrationBehavior applies to the plan changes between products without their own ProrationBehaviors entry
+	DefaultProrationBehavior string
+	ProrationBehaviors       map[ProductPair]string
+	// Regions holds the regional prices, by customer country
+	Regions []PricingRegion
+	Tax     TaxSettings
+	// CheckoutRecovery asks Stripe for a recovery URL of the abandoned checkouts
+	CheckoutRecovery bool
 }
 
-// NewStripeService creates a new instance of the StripeService
-func NewStripeService(stripeSecretKey, stripeWebhookSecretKey string, products []string, prod bool, collection *repository.Collections) *StripeService {
-	stripe.Key = stripeSecretKey
+// NewStripeService creates a new instance of the StripeService.
+// The Stripe keys are read from secretProvider on use, so rotated keys are picked up without a restart.
+// Users are told about billing events through notifier, they are only logged when it is nil.
+func NewStripeService(secretProvider secrets.Provider, settings StripeSettings, prod bool, collection *repository.Collections, notifier Notifier) *StripeService {
+	if notifier == nil {
+		notifier = LogNotifier{}
+	}
 	return &StripeService{
-		stripeSecretKey:        stripeSecretKey,
-		stripeWebhookSecretKey: stripeWebhookSecretKey,
-		products:               products,
-		isProd:                 prod,
-		repo:                   collection,
+		secrets:  secretProvider,
+		settings: settings,
+		isProd:   prod,
+		repo:     collection,
+		notifier: notifier,
 	}
 }
 
+// client returns the Stripe client for the current secret key.
+// When the key can't be read, the client of the last known key is kept.
+func (s *StripeService) client(ctx context.Context) *client.API {
+	key, err := s.secrets.Get(ctx, secrets.StripeSecretKey)
+
+	s.apiMu.Lock()
+	defer s.apiMu.Unlock()
+
+	if err != nil {
+		logger.FromContext(ctx).Error("error reading stripe secret key", "error", err)
+		if s.api == nil {
+			s.api = client.New("", nil)
+		}
+		return s.api
+	}
+
+	if s.api == nil || key != s.apiKey {
+		if s.api != nil {
+			logger.FromContext(ctx).Info("stripe secret key rotated")
+		}
+		s.api = client.New(key, nil)
+		s.apiKey = key
+	}
+	return s.api
+}
+
 // AllowedStripeIPs are the IPs from which Stripe sends webhooks
 var AllowedStripeIPs = []string{
 	"3.18.12.63",
@@ -73,6 +129,7 @@ var (
 	ErrParsingWebhookJSON    = errors.New("error parsing webhook JSON")
 	ErrSubscriptionNotFound  = errors.New("subscription not found")
 	ErrCustomUserIdNotExist  = errors.New("custom user id does not exist")
+	ErrIncompleteSession     = errors.New("checkout session has no subscription, customer or invoice")
 )
 
 // Handling Invoices Error
@@ -94,6 +151,13 @@ var (
 // Handling products errors
 var (
 	ErrorGettingProduct = errors.New("error getting product")
+	ErrUnknownProduct   = errors.New("unknown product ID")
+)
+
+// Handling prices errors
+var (
+	ErrorGettingPrice    = errors.New("error getting price")
+	ErrPriceNotInProduct = errors.New("price does not belong to the product")
 )
 
 // Handling checkout creation errors
@@ -101,52 +165,66 @@ var (
 	ErrorCreatingCheckout = errors.New("error creating checkout session")
 )
 
-// CreateCustomer creates a new customer in Stripe
-func (s *StripeService) CreateCustomer(userId string) (*stripe.Customer, error) {
+// CreateCustomer creates a new customer in Stripe, its address country is set when country is known.
+// Creations for the same user and country within 24 hours return the same customer.
+func (s *StripeService) CreateCustomer(ctx context.Context, userId, country string) (*stripe.Customer, error) {
 	customerParams := &stripe.CustomerParams{
 		Metadata: map[string]string{
 			"userId": userId,
 		},
-		Address: &stripe.AddressParams{
-			Country: stripe.String("FR"),
-		},
 	}
-	customerData, err := customer.New(customerParams)
+	if country != "" {
+		customerParams.Address = &stripe.AddressParams{
+			Country: stripe.String(country),
+		}
+	}
+	// Customer Search lags behind creations, a retry that doesn't find the new customer yet gets it back instead of a second one
+	customerParams.SetIdempotencyKey("customer:" + userId + ":" + country)
+	ctx, done := startStripeCall(ctx, "CreateCustomer")
+	customerParams.Context = ctx
+	customerData, err := s.client(ctx).Customers.New(customerParams)
+	done(err)
 	if err != nil {
-		log.Printf("Error creating customer: %v", err)
+		logger.FromContext(ctx).Error("error creating customer", "userId", userId, "error", err)
 		return nil, ErrCreatingCustomer
 	}
 	return customerData, nil
 }
 
 // GetCustomer retrieves a customer from Stripe
-func (s *StripeService) GetCustomer(customerId string) (*stripe.Customer, error) {
+func (s *StripeService) GetCustomer(ctx context.Context, customerId string) (*stripe.Customer, error) {
 	customerParams := &stripe.CustomerParams{}
-	customerData, err := customer.Get(customerId, customerParams)
+	ctx, done := startStripeCall(ctx, "GetCustomer")
+	customerParams.Context = ctx
+	customerData, err := s.client(ctx).Customers.Get(customerId, customerParams)
+	done(err)
 	if err != nil {
-		log.Printf("Error getting customer: %v", err)
+		logger.FromContext(ctx).Error("error getting customer", "customerId", customerId, "error", err)
 		return nil, ErrGettingCustomer
 	}
 	return customerData, nil
 }
 
 // GetCustomerByUserId retrieves a customer from Stripe
-func (s *StripeService) GetCustomerByUserId(userId string) (*stripe.Customer, error) {
+func (s *StripeService) GetCustomerByUserId(ctx context.Context, userId string) (*stripe.Customer, error) {
 
 	params := &stripe.CustomerSearchParams{
 		SearchParams: stripe.SearchParams{
 			Query: "metadata['userId']:'" + userId + "'",
 		},
 	}
-	result := customer.Search(params)
+	ctx, done := startStripeCall(ctx, "SearchCustomers")
+	params.Context = ctx
+	result := s.client(ctx).Customers.Search(params)
 	customers := result.CustomerSearchResult().Data
+	done(result.Err())
 	if len(customers) < 1 {
-		log.Printf("Error getting customer: %v", ErrGettingCustomer)
+		logger.FromContext(ctx).Error("error getting customer", "userId", userId, "error", ErrGettingCustomer)
 		return nil, ErrGettingCustomer
 	}
 
 	if customers[0].Metadata["userId"] != userId {
-		log.Printf("Error getting customer: %v", ErrGettingCustomer)
+		logger.FromContext(ctx).Error("error getting customer", "userId", userId, "error", ErrGettingCustomer)
 		return nil, ErrGettingCustomer
 	}
 
@@ -156,27 +234,61 @@ func (s *StripeService) GetCustomerByUserId(userId string) (*stripe.Customer, er
 //Products
 
 // GetProduct retrieves a product from Stripe
-func (s *StripeService) GetProduct(productId string) (*stripe.Product, error) {
+func (s *StripeService) GetProduct(ctx context.Context, productId string) (*stripe.Product, error) {
 	params := &stripe.ProductParams{}
-	productData, err := product.Get(productId, params)
+	params.AddExpand("default_price")
+	ctx, done := startStripeCall(ctx, "GetProduct")
+	params.Context = ctx
+	productData, err := s.client(ctx).Products.Get(productId, params)
+	done(err)
 
 	if err != nil {
-		log.Printf("Error getting product: %v", err)
+		logger.FromContext(ctx).Error("error getting product", "productId", productId, "error", err)
 		return nil, ErrorGettingProduct
 	}
 
 	return productData, nil
 }
 
+// ValidateProducts checks that every configured product exists in Stripe and returns every unknown one
+func (s *StripeService) ValidateProducts(ctx context.Context) error {
+	var errs []error
+	for _, productId := range s.settings.Products {
+		if _, err := s.GetProduct(ctx, productId); err != nil {
+			errs = append(errs, fmt.Errorf("products (PRODUCTS): %w %q", ErrUnknownProduct, productId))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// GetPrice retrieves a price from Stripe
+func (s *StripeService) GetPrice(ctx context.Context, priceId string) (*stripe.Price, error) {
+	params := &stripe.PriceParams{}
+	ctx, done := startStripeCall(ctx, "GetPrice")
+	params.Context = ctx
+	priceData, err := s.client(ctx).Prices.Get(priceId, params)
+	done(err)
+
+	if err != nil {
+		logger.FromContext(ctx).Error("error getting price", "priceId", priceId, "error", err)
+		return nil, ErrorGettingPrice
+	}
+
+	return priceData, nil
+}
+
 //Invoices
 
 // GetInvoice retrieves an invoice from Stripe
-func (s *StripeService) GetInvoice(invoiceId string) (*stripe.Invoice, error) {
+func (s *StripeService) GetInvoice(ctx context.Context, invoiceId string) (*stripe.Invoice, error) {
 	params := &stripe.InvoiceParams{}
-	invoiceData, err := invoice.Get(invoiceId, params)
+	ctx, done := startStripeCall(ctx, "GetInvoice")
+	params.Context = ctx
+	invoiceData, err := s.client(ctx).Invoices.Get(invoiceId, params)
+	done(err)
 
 	if err != nil {
-		log.Printf("Error getting invoice: %v", err)
+		logger.FromContext(ctx).Error("error getting invoice", "invoiceId", invoiceId, "error", err)
 		return nil, ErrGettingInvoice
 	}
 
@@ -186,12 +298,15 @@ func (s *StripeService) GetInvoice(invoiceId string) (*stripe.Invoice, error) {
 //Subscriptions
 
 // GetSubscription retrieves a subscription from Stripe
-func (s *StripeService) GetSubscription(subscriptionId string) (*stripe.Subscription, error) {
+func (s *StripeService) GetSubscription(ctx context.Context, subscriptionId string) (*stripe.Subscription, error) {
 	params := &stripe.SubscriptionParams{}
-	subscriptionData, err := subscription.Get(subscriptionId, params)
+	ctx, done := startStripeCall(ctx, "GetSubscription")
+	params.Context = ctx
+	subscriptionData, err := s.client(ctx).Subscriptions.Get(subscriptionId, params)
+	done(err)
 
 	if err != nil {
-		log.Printf("Error getting subscription: %v", err)
+		logger.FromContext(ctx).Error("error getting subscription", "subscriptionId", subscriptionId, "error", err)
 		return nil, ErrGettingSubscription
 	}
 
@@ -206,11 +321,12 @@ func (s *StripeService) AuthenticateWebhook(c *gin.Context) (stripe.Event, error
 		AllowedStripeIPs = append(AllowedStripeIPs, "::1")
 	}
 	req := c.Request
+	log := logger.FromContext(req.Context())
 	ipFromStripe := c.ClientIP()
 
 	// Checks webhook coming from allowed IP
 	if !slices.Contains[[]string](AllowedStripeIPs[:], ipFromStripe) {
-		log.Printf("Error authenticating webhook: %v", ErrWebhookNotFromStripe)
+		log.Warn("error authenticating webhook", "clientIp", ipFromStripe, "error", ErrWebhookNotFromStripe)
 		return stripe.Event{}, ErrWebhookNotFromStripe
 	}
 
@@ -222,13 +338,19 @@ func (s *StripeService) AuthenticateWebhook(c *gin.Context) (stripe.Event, error
 
 	body, err := io.ReadAll(req.Body)
 	if err != nil {
-		log.Printf("Error reading request body: %v", err)
+		log.Warn("error reading request body", "error", err)
 		return stripe.Event{}, ErrReadingRequestBody
 	}
 
-	event, err := webhook.ConstructEvent(body, signatureHeader, s.stripeWebhookSecretKey)
+	webhookSecretKey, err := s.secrets.Get(req.Context(), secrets.StripeWebhookSecretKey)
+	if err != nil {
+		log.Error("error reading stripe webhook secret key", "error", err)
+		return stripe.Event{}, ErrorVerifyingSignature
+	}
+
+	event, err := webhook.ConstructEvent(body, signatureHeader, webhookSecretKey)
 	if err != nil {
-		log.Printf("Error verifying signature: %v", err)
+		log.Warn("error verifying signature", "error", err)
 		return stripe.Event{}, ErrorVerifyingSignature
 	}
 
@@ -236,21 +358,37 @@ func (s *StripeService) AuthenticateWebhook(c *gin.Context) (stripe.Event, error
 }
 
 // HandleEvents from webhooks
-func (s *StripeService) HandleEvents(e stripe.Event) error {
+func (s *StripeService) HandleEvents(ctx context.Context, e stripe.Event) (err error) {
+	ctx, span := tracing.Start(ctx, "stripe.webhook "+string(e.Type),
+		attribute.String("stripe.event.id", e.ID),
+		attribute.String("stripe.event.type", string(e.Type)),
+	)
+	defer func() {
+		// Unhandled event types are expected, don't flag them as failed spans
+		if errors.Is(err, ErrorHandlingStripeEvent) {
+			tracing.End(span, nil)
+			return
+		}
+		tracing.End(span, err)
+	}()
+
+	ctx = logger.With(ctx, "eventId", e.ID, "eventType", string(e.Type))
+	log := logger.FromContext(ctx)
+
 	switch e.Type {
 
 	case "customer.subscription.updated":
 		var customerSubscription stripe.Subscription
 		err := json.Unmarshal(e.Data.Raw, &customerSubscription)
 		if err != nil {
-			log.Printf("Error parsing webhook JSON: %v", err)
+			log.Error("error parsing webhook JSON", "error", err)
 			return ErrParsingWebhookJSON
 		}
 
 		if customerSubscription.ID != "" {
-			err = s.handleSubscriptionUpdate(customerSubscription)
+			err = s.handleSubscriptionUpdate(ctx, customerSubscription)
 			if err != nil {
-				log.Printf("Error handling subscription update: %v", err)
+				log.Error("error handling subscription update", "subscriptionId", customerSubscription.ID, "error", err)
 				return err
 			}
 		}
@@ -258,67 +396,136 @@ func (s *StripeService) HandleEvents(e stripe.Event) error {
 		var customerSubscription stripe.Subscription
 		err := json.Unmarshal(e.Data.Raw, &customerSubscription)
 		if err != nil {
-			log.Printf("Error parsing webhook JSON: %v", err)
+			log.Error("error parsing webhook JSON", "error", err)
 			return ErrParsingWebhookJSON
 		}
 
 		if customerSubscription.ID != "" {
-			err = s.handleSubscriptionCancellation(customerSubscription)
+			err = s.handleSubscriptionCancellation(ctx, customerSubscription)
 			if err != nil {
-				log.Printf("Error handling subscription cancellation: %v", err)
+				log.Error("error handling subscription cancellation", "subscriptionId", customerSubscription.ID, "error", err)
 				return err
 			}
 		} else {
-			log.Printf("Error handling subscription cancellation: %v", ErrSubscriptionNotFound)
+			log.Error("error handling subscription cancellation", "error", ErrSubscriptionNotFound)
 			return ErrSubscriptionNotFound
 		}
 		return nil
+	case "customer.subscription.trial_will_end":
+		var customerSubscription stripe.Subscription
+		err := json.Unmarshal(e.Data.Raw, &customerSubscription)
+		if err != nil {
+			log.Error("error parsing webhook JSON", "error", err)
+			return ErrParsingWebhookJSON
+		}
+
+		err = s.handleTrialWillEnd(ctx, customerSubscription)
+		if err != nil {
+			log.Error("error handling trial end", "subscriptionId", customerSubscription.ID, "error", err)
+			return err
+		}
 	case "checkout.session.completed":
 		var sessionData stripe.CheckoutSession
 		err := json.Unmarshal(e.Data.Raw, &sessionData)
 		if err != nil {
-			log.Printf("Error parsing webhook JSON: %v", err)
+			log.Error("error parsing webhook JSON", "error", err)
 			return ErrParsingWebhookJSON
 		}
 
 		// Handle payment completion
-		if sessionData.Mode == stripe.CheckoutSessionModeSubscription {
-			return s.handleSubscriptionPaymentCompletion(sessionData)
+		return s.fulfillCheckout(ctx, sessionData)
+	case "checkout.session.async_payment_succeeded":
+		var sessionData stripe.CheckoutSession
+		err := json.Unmarshal(e.Data.Raw, &sessionData)
+		if err != nil {
+			log.Error("error parsing webhook JSON", "error", err)
+			return ErrParsingWebhookJSON
+		}
+
+		return s.handleAsyncPaymentSucceeded(ctx, sessionData)
+	case "checkout.session.async_payment_failed":
+		var sessionData stripe.CheckoutSession
+		err := json.Unmarshal(e.Data.Raw, &sessionData)
+		if err != nil {
+			log.Error("error parsing webhook JSON", "error", err)
+			return ErrParsingWebhookJSON
+		}
+
+		return s.handleAsyncPaymentFailed(ctx, sessionData)
+	case "checkout.session.expired":
+		var sessionData stripe.CheckoutSession
+		err := json.Unmarshal(e.Data.Raw, &sessionData)
+		if err != nil {
+			log.Error("error parsing webhook JSON", "error", err)
+			return ErrParsingWebhookJSON
 		}
+
+		return s.handleCheckoutExpired(ctx, sessionData)
+	case "product.created", "product.updated", "product.deleted", "price.created", "price.updated", "price.deleted":
+		s.invalidateCatalog()
+		log.Info("catalog cache cleared")
 	default:
-		log.Printf("Error handling stripe event: %v", ErrorHandlingStripeEvent)
+		log.Warn("unhandled stripe event", "error", ErrorHandlingStripeEvent)
 		return ErrorHandlingStripeEvent
 	}
 	return nil
 }
 
+// fulfillCheckout records the subscription or purchase of a completed checkout.
+// It runs for the webhook and for the user coming back from the checkout, whichever comes first, the other one does nothing.
+func (s *StripeService) fulfillCheckout(ctx context.Context, checkoutSession stripe.CheckoutSession) error {
+	s.recordCheckoutCompletion(ctx, checkoutSession)
+
+	switch checkoutSession.Mode {
+	case stripe.CheckoutSessionModeSubscription:
+		return s.handleSubscriptionPaymentCompletion(ctx, checkoutSession)
+	case stripe.CheckoutSessionModePayment:
+		return s.handleOneTimePaymentCompletion(ctx, checkoutSession)
+	}
+	return nil
+}
+
 // handleSubscriptionPaymentCompletion handles the completion of a subscription payment
-func (s *StripeService) handleSubscriptionPaymentCompletion(checkoutSession stripe.CheckoutSession) error {
-	customerData, err := s.GetCustomer(checkoutSession.Customer.ID)
+func (s *StripeService) handleSubscriptionPaymentCompletion(ctx context.Context, checkoutSession stripe.CheckoutSession) error {
+	log := logger.FromContext(ctx)
+	if checkoutSession.Subscription == nil || checkoutSession.Customer == nil || checkoutSession.Invoice == nil {
+		log.Error("error handling subscription payment completion", "sessionId", checkoutSession.ID, "error", ErrIncompleteSession)
+		return ErrIncompleteSession
+	}
+	ctx = logger.With(ctx, "subscriptionId", checkoutSession.Subscription.ID)
+	log = logger.FromContext(ctx)
+
+	customerData, err := s.GetCustomer(ctx, checkoutSession.Customer.ID)
 	if err != nil {
 		return err
 	}
 
 	customerUserId := checkoutSession.ClientReferenceID
 	if customerUserId == "" {
-		log.Printf("Error handling one-time payment completion: %v", ErrCustomUserIdNotExist)
+		log.Error("error handling subscription payment completion", "sessionId", checkoutSession.ID, "error", ErrCustomUserIdNotExist)
 		return ErrCustomUserIdNotExist
 	}
 
-	invoiceData, err := s.GetInvoice(checkoutSession.Invoice.ID)
+	invoiceData, err := s.GetInvoice(ctx, checkoutSession.Invoice.ID)
+	if err != nil {
+		return err
+	}
+
+	subscriptionData, err := s.GetSubscription(ctx, checkoutSession.Subscription.ID)
 	if err != nil {
 		return err
 	}
 
-	subscriptionData, err := s.GetSubscription(checkoutSession.Subscription.ID)
+	items, err := s.sessionItems(ctx, checkoutSession.ID)
 	if err != nil {
 		return err
 	}
 
 	subscriptionStatus := subscriptionData.Status // Possible values are `incomplete`, `incomplete_expired`, `trialing`, `active`, `past_due`, `canceled`, or `unpaid`.
+	interval, intervalCount := priceInterval(subscriptionData.Items.Data[0].Price)
 	expireDateTimestamp := subscriptionData.Items.Data[0].CurrentPeriodEnd * 1000
-	// Add 12h as a security. Sometimes the invoice takes some time to be processed even when there's nothing wrong with the payment methods.
-	expireDateTimestamp += TwelveHoursInMilliseconds
+	// Add a grace period as a security. Sometimes the invoice takes some time to be processed even when there's nothing wrong with the payment methods.
+	expireDateTimestamp += s.settings.GracePeriod.Milliseconds()
 
 	subscriptionModel := &models.Subscription{
 		UserId:         customerUserId,
@@ -328,8 +535,11 @@ func (s *StripeService) handleSubscriptionPaymentCompletion(checkoutSession stri
 		InvoiceNumber:  invoiceData.Number,
 		IsTest:         invoiceData.Livemode,
 		IsOneTime:      false,
-		Status:         string(subscriptionStatus),
+		Discount:       s.discountFromSession(ctx, checkoutSession),
+		Tax:            taxFromInvoice(invoiceData),
+		Status:         checkoutPaymentStatus(checkoutSession, string(subscriptionStatus)),
 		EndsAt:         expireDateTimestamp,
+		TrialEndsAt:    subscriptionData.TrialEnd * 1000,
 		CreatedAt:      subscriptionData.Created * 1000,
 		IsCanceled:     false,
 		RenewsAt:       expireDateTimestamp,
@@ -340,59 +550,194 @@ func (s *StripeService) handleSubscriptionPaymentCompletion(checkoutSession stri
 			CustomerId: customerData.ID,
 		},
 		Plan: models.PlanInSubscription{
-			SessionId: checkoutSession.ID,
-			ProductId: subscriptionData.Items.Data[0].Price.Product.ID,
-			Price:     float32(invoiceData.Total / 100),
+			SessionId:     checkoutSession.ID,
+			ProductId:     subscriptionData.Items.Data[0].Price.Product.ID,
+			PriceId:       subscriptionData.Items.Data[0].Price.ID,
+			Price:         float32(invoiceData.Total) / 100,
+			Interval:      interval,
+			IntervalCount: intervalCount,
 		},
+		Items: items,
+	}
+
+	// Remember who used the trial so that other accounts of the same person can't start another one.
+	// It runs before the subscription is saved: when it fails, the checkout is not fulfilled yet and the next attempt runs it again.
+	if subscriptionData.TrialEnd > 0 {
+		err = s.recordTrialUsage(ctx, customerUserId, customerData, subscriptionData)
+		if err != nil {
+			return err
+		}
 	}
 
-	err = s.repo.PaymentCollection.Save(subscriptionModel)
+	err = s.repo.PaymentCollection.Save(ctx, subscriptionModel)
+	if errors.Is(err, repository.ErrSubscriptionAlreadyExists) {
+		log.Info("checkout already fulfilled", "sessionId", checkoutSession.ID)
+		return nil
+	}
+	if err != nil {
+		err := s.repo.PaymentCollection.Update(ctx, subscriptionModel)
+		if err != nil {
+			log.Error("error updating payment", "error", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// handleOneTimePaymentCompletion handles the completion of a one-time payment, the purchase is stored under the session ID
+func (s *StripeService) handleOneTimePaymentCompletion(ctx context.Context, checkoutSession stripe.CheckoutSession) error {
+	ctx = logger.With(ctx, "sessionId", checkoutSession.ID)
+	log := logger.FromContext(ctx)
+
+	customerUserId := checkoutSession.ClientReferenceID
+	if customerUserId == "" {
+		log.Error("error handling one-time payment completion", "error", ErrCustomUserIdNotExist)
+		return ErrCustomUserIdNotExist
+	}
+
+	items, err := s.sessionItems(ctx, checkoutSession.ID)
 	if err != nil {
-		err := s.repo.PaymentCollection.Update(subscriptionModel)
+		return err
+	}
+	if len(items) == 0 {
+		log.Error("error handling one-time payment completion", "error", ErrEmptyCart)
+		return ErrEmptyCart
+	}
+
+	purchaseModel := &models.Subscription{
+		UserId:         customerUserId,
+		SubscriptionID: checkoutSession.ID,
+		IsTest:         !checkoutSession.Livemode,
+		IsOneTime:      true,
+		Discount:       s.discountFromSession(ctx, checkoutSession),
+		Tax:            taxFromSession(checkoutSession),
+		Status:         checkoutPaymentStatus(checkoutSession, string(checkoutSession.PaymentStatus)),
+		// One-time purchases never expire
+		EndsAt:    -1,
+		CreatedAt: checkoutSession.Created * 1000,
+		UpdatedAt: time.Now().UnixMilli(),
+		Plan: models.PlanInSubscription{
+			SessionId: checkoutSession.ID,
+			ProductId: items[0].ProductId,
+			PriceId:   items[0].PriceId,
+			Price:     float32(checkoutSession.AmountTotal) / 100,
+		},
+		Items: items,
+	}
+	if checkoutSession.CustomerDetails != nil {
+		purchaseModel.User.Email = checkoutSession.CustomerDetails.Email
+		purchaseModel.User.Name = checkoutSession.CustomerDetails.Name
+	}
+	if checkoutSession.Customer != nil {
+		purchaseModel.User.CustomerId = checkoutSession.Customer.ID
+	}
+	if checkoutSession.Invoice != nil {
+		invoiceData, err := s.GetInvoice(ctx, checkoutSession.Invoice.ID)
 		if err != nil {
-			log.Printf("Error updating payment: %v", err)
 			return err
 		}
+		purchaseModel.InvoiceLink = invoiceData.HostedInvoiceURL
+		purchaseModel.InvoicePDF = invoiceData.InvoicePDF
+		purchaseModel.InvoiceNumber = invoiceData.Number
+	}
+
+	err = s.repo.PaymentCollection.Save(ctx, purchaseModel)
+	if errors.Is(err, repository.ErrSubscriptionAlreadyExists) {
+		log.Info("checkout already fulfilled")
+		return nil
+	}
+	if err != nil {
+		err := s.repo.PaymentCollection.Update(ctx, purchaseModel)
+		if err != nil {
+			log.Error("error updating payment", "error", err)
+			return ErrorSavingOneTimePurchase
+		}
 	}
 
 	return nil
 }
 
 // handleSubscriptionUpdate handles the update of a subscription
-func (s *StripeService) handleSubscriptionUpdate(subscription stripe.Subscription) error {
+func (s *StripeService) handleSubscriptionUpdate(ctx context.Context, subscription stripe.Subscription) error {
+	ctx = logger.With(ctx, "subscriptionId", subscription.ID)
+	log := logger.FromContext(ctx)
+
 	subscriptionStatus := subscription.Status // Possible values are `incomplete`, `incomplete_expired`, `trialing`, `active`, `past_due`, `canceled`, or `unpaid`.
 	expireDateTimestamp := subscription.Items.Data[0].CurrentPeriodEnd * 1000
-	// Add 12h as a security. Sometimes the invoice takes some time to be processed even when there's nothing wrong with the payment methods.
-	expireDateTimestamp += TwelveHoursInMilliseconds
+	// Add a grace period as a security. Sometimes the invoice takes some time to be processed even when there's nothing wrong with the payment methods.
+	expireDateTimestamp += s.settings.GracePeriod.Milliseconds()
 	// get invoice data
-	invoiceData, err := s.GetInvoice(subscription.LatestInvoice.ID)
+	invoiceData, err := s.GetInvoice(ctx, subscription.LatestInvoice.ID)
 	if err != nil {
 		return err
 	}
 
 	// update user subscription status and expire date
-	subscriptionData, err := s.repo.PaymentCollection.Get(subscription.ID)
+	subscriptionData, err := s.repo.PaymentCollection.Get(ctx, subscription.ID)
 	if err != nil {
-		log.Printf("Error getting subscription: %v", err)
+		log.Error("error getting subscription", "error", err)
 		return ErrSubscriptionNotFound
 	}
-	subscriptionData.Plan = models.PlanInSubscription{
-		ProductId: subscription.Items.Data[0].Price.Product.ID,
-		Price:     float32(invoiceData.Total / 100),
-		SessionId: subscriptionData.Plan.SessionId,
+	scheduledChange := subscriptionData.Plan.ScheduledChange
+	// The scheduled plan change is over once the subscription is on its price, or when its schedule was released or canceled
+	if scheduledChange != nil && (subscription.Schedule == nil || slices.ContainsFunc(subscription.Items.Data, func(item *stripe.SubscriptionItem) bool {
+		return item.Price.ID == scheduledChange.PriceId
+	})) {
+		scheduledChange = nil
 	}
+	interval, intervalCount := priceInterval(subscription.Items.Data[0].Price)
+	subscriptionData.Plan = models.PlanInSubscription{
+		ProductId:       subscription.Items.Data[0].Price.Product.ID,
+		PriceId:         subscription.Items.Data[0].Price.ID,
+		Price:           float32(invoiceData.Total) / 100,
+		Interval:        interval,
+		IntervalCount:   intervalCount,
+		SessionId:       subscriptionData.Plan.SessionId,
+		ScheduledChange: scheduledChange,
+	}
+	subscriptionData.Items = subscriptionItems(&subscription, subscriptionData.Items)
 	subscriptionData.InvoicePDF = invoiceData.InvoicePDF
 	subscriptionData.InvoiceLink = invoiceData.HostedInvoiceURL
 	subscriptionData.InvoiceNumber = invoiceData.Number
-	subscriptionData.Status = string(subscriptionStatus)
+	subscriptionData.Tax = taxFromInvoice(invoiceData)
+	subscriptionData.Status = subscriptionUpdateStatus(subscriptionData.Status, subscriptionStatus)
+	paidUntil := subscriptionData.EndsAt
 	subscriptionData.EndsAt = expireDateTimestamp
 	subscriptionData.RenewsAt = expireDateTimestamp
+	subscriptionData.TrialEndsAt = subscription.TrialEnd * 1000
 	subscriptionData.UpdatedAt = time.Now().UnixMilli()
 	subscriptionData.IsCanceled = subscription.CancelAtPeriodEnd
+	// Billing can be paused and resumed outside of the API, and resumes by itself at the resume date
+	if subscription.PauseCollection == nil {
+		subscriptionData.Pause = nil
+	} else {
+		pause := &models.PauseInSubscription{
+			Behavior:     string(subscription.PauseCollection.Behavior),
+			ResumesAt:    subscription.PauseCollection.ResumesAt * 1000,
+			PausedAt:     time.Now().UnixMilli(),
+			AccessEndsAt: paidUntil,
+		}
+		if subscriptionData.Pause != nil {
+			pause.PausedAt = subscriptionData.Pause.PausedAt
+			pause.AccessEndsAt = subscriptionData.Pause.AccessEndsAt
+		}
+		subscriptionData.Pause = pause
+	}
+	// Cancellations made outside of the API, such as in the billing portal, carry their reason in the cancellation details
+	if !subscription.CancelAtPeriodEnd {
+		subscriptionData.Cancellation = nil
+	} else if subscriptionData.Cancellation == nil && subscription.CancellationDetails != nil {
+		subscriptionData.Cancellation = &models.CancellationInSubscription{
+			Reason:      string(subscription.CancellationDetails.Feedback),
+			Feedback:    subscription.CancellationDetails.Comment,
+			RequestedAt: subscription.CanceledAt * 1000,
+		}
+	}
 
-	err = s.repo.PaymentCollection.Update(subscriptionData)
+	err = s.repo.PaymentCollection.Update(ctx, subscriptionData)
 	if err != nil {
-		log.Printf("Error updating payment: %v", err)
+		log.Error("error updating payment", "error", err)
 		return err
 	}
 
@@ -400,18 +745,20 @@ func (s *StripeService) handleSubscriptionUpdate(subscription stripe.Subscriptio
 }
 
 // handleSubscriptionCancellation handles the cancellation of a subscription
-func (s *StripeService) handleSubscriptionCancellation(subscription stripe.Subscription) error {
+func (s *StripeService) handleSubscriptionCancellation(ctx context.Context, subscription stripe.Subscription) error {
+	ctx = logger.With(ctx, "subscriptionId", subscription.ID)
+	log := logger.FromContext(ctx)
 
-	_, err := s.repo.PaymentCollection.Get(subscription.ID)
+	_, err := s.repo.PaymentCollection.Get(ctx, subscription.ID)
 	if err != nil {
-		log.Printf("Error getting subscription: %v", err)
+		log.Error("error getting subscription", "error", err)
 		return ErrSubscriptionNotFound
 	}
 
-	err = s.repo.PaymentCollection.Delete(subscription.ID)
+	err = s.repo.PaymentCollection.Delete(ctx, subscription.ID)
 	if err != nil {
 		if errors.Is(err, repository.ErrorDeletingSubscription) {
-			log.Printf("Error deleting subscription: %v", err)
+			log.Error("error deleting subscription", "error", err)
 			return err
 		}
 	}
@@ -421,52 +768,153 @@ func (s *StripeService) handleSubscriptionCancellation(subscription stripe.Subsc
 
 // Checkouts
 
-// GetCheckoutSession returns the Stripe checkout session
-func (s *StripeService) GetCheckoutSession(request types.StripeCheckoutRequest) (*stripe.CheckoutSession, error) {
+// CheckoutResult is the outcome of GetCheckoutSession
+type CheckoutResult struct {
+	Session *stripe.CheckoutSession
+}
+
+// GetCheckoutSession returns the Stripe checkout session of a cart, its first item being the main product.
+// Prices are replaced by the prices of the region of the country resolved from request.Country, the billing address of the user
+// and request.IPCountry.
+// When the user already has a valid subscription in the group of the main product, the product policy blocks the checkout
+// with an ExistingSubscriptionError. The change policy offers the plan change of the existing subscription in the error,
+// it is only applied once the user confirms it through ChangePlan.
+func (s *StripeService) GetCheckoutSession(ctx context.Context, request types.StripeCheckoutRequest) (*CheckoutResult, error) {
+
+	// The customers of the user are searched once, for the country, the trial eligibility and the tax
+	customers, customersErr := s.userCustomers(ctx, request.UserId)
+	if err := customersErr; err != nil {
+		if s.settings.Tax.enabled() {
+			// Taxed checkouts are attached to the customer of the user, a new customer would duplicate it
+			logger.FromContext(ctx).Error("error searching customers of the user", "error", err)
+			return nil, ErrGettingCustomer
+		}
+		logger.FromContext(ctx).Warn("error searching customers of the user", "error", err)
+	}
+	request.Country = resolveCountry(request.Country, request.IPCountry, customers)
+
+	lines, err := s.checkoutLines(ctx, request, s.pricingRegion(request.Country))
+	if err != nil {
+		return nil, err
+	}
+	priceData := lines[0].price
 
-	//Get the product data
-	productData, err := s.GetProduct(request.ProductId)
+	//Get the main product data
+	productData, err := s.GetProduct(ctx, priceData.Product.ID)
 	if err != nil {
 		return nil, err
 	}
 
-	//Get the checkout mode by checking if the product is a subscription or not
+	//Get the checkout mode by checking if the product is a subscription or not, Stripe needs a subscription for recurring prices
 	var isSubscription bool
 	var checkoutMode stripe.CheckoutSessionMode
-	isSubscription = productData.Metadata["subs"] == "true"
+	isSubscription = productData.Metadata["subs"] == "true" || slices.ContainsFunc(lines, func(line checkoutLine) bool {
+		return line.price.Recurring != nil
+	})
 	if isSubscription {
 		checkoutMode = stripe.CheckoutSessionModeSubscription
 	} else {
 		checkoutMode = stripe.CheckoutSessionModePayment
 	}
-	isTrial := productData.Metadata["trial"] == "true"
+	if isSubscription {
+		policy := s.productSettings(productData.ID).ExistingSubscription
+		if policy != PolicyAllow {
+			existing, err := s.findExistingSubscription(ctx, request.UserId, productData.ID)
+			if err != nil {
+				return nil, err
+			}
+			if existing != nil {
+				// A plan change only switches the price of the subscription, carts with more items are only blocked
+				var planChange *PlanChangeOffer
+				if policy == PolicyChange && len(lines) == 1 {
+					planChange = &PlanChangeOffer{
+						ProductId: existing.Plan.ProductId,
+						PriceId:   priceData.ID,
+						Quantity:  lines[0].item.Quantity,
+					}
+				}
+				return nil, s.existingSubscriptionError(ctx, existing, request.CancelURL, planChange)
+			}
+		}
+	}
 
 	checkoutParams := &stripe.CheckoutSessionParams{
 		Mode:              stripe.String(string(checkoutMode)),
-		SuccessURL:        stripe.String(request.ReturnURL),
-		CancelURL:         stripe.String(request.ReturnURL),
 		ClientReferenceID: stripe.String(request.UserId),
-		LineItems: []*stripe.CheckoutSessionLineItemParams{
-			{
-				Price:    stripe.String(productData.DefaultPrice.ID),
-				Quantity: stripe.Int64(1),
-			},
-		},
+		LineItems:         lineItemParams(lines),
+	}
+	err = applyUIMode(checkoutParams, request.UIMode, request.SuccessURL, request.CancelURL, request.ReturnURL)
+	if err != nil {
+		return nil, err
+	}
+	s.applyRecovery(checkoutParams, request.UIMode)
+
+	// A code given with the request is applied right away, otherwise the products allowing it let the user type one on the payment page
+	if request.PromotionCode != "" {
+		promotionCode, err := s.GetPromotionCode(ctx, request.PromotionCode)
+		if err != nil {
+			return nil, err
+		}
+		err = validatePromotionCode(promotionCode, lines, customers)
+		if err != nil {
+			return nil, err
+		}
+		if restrictions := promotionCode.Restrictions; restrictions != nil && restrictions.FirstTimeTransaction {
+			// Without the customers of the user, a returning user can't be told from a new one
+			if customersErr != nil {
+				return nil, ErrGettingCustomer
+			}
+			err = s.checkFirstPurchase(ctx, customers)
+			if err != nil {
+				return nil, err
+			}
+		}
+		// Stripe only accepts a code reserved to a customer on a session of this customer
+		if promotionCode.Customer != nil {
+			checkoutParams.Customer = stripe.String(promotionCode.Customer.ID)
+		}
+		checkoutParams.Discounts = []*stripe.CheckoutSessionDiscountParams{
+			{PromotionCode: stripe.String(promotionCode.ID)},
+		}
+	} else if s.allowPromotionCodes(productData) {
+		checkoutParams.AllowPromotionCodes = stripe.Bool(true)
+	}
+
+	// Retries of the same client request must not create a second session
+	if request.IdempotencyKey != "" {
+		checkoutParams.SetIdempotencyKey("checkout:" + request.UserId + ":" + request.IdempotencyKey)
 	}
 
 	if isSubscription {
-		if isTrial {
-			checkoutParams.SubscriptionData = &stripe.CheckoutSessionSubscriptionDataParams{
-				TrialPeriodDays: stripe.Int64(14),
+		trial := s.trialPolicy(ctx, productData, priceData)
+		if trial.Days > 0 {
+			eligibility, err := s.CheckTrialEligibility(ctx, request.UserId, customerIdentities(customers)...)
+			if err != nil {
+				return nil, err
+			}
+			if !eligibility.Eligible {
+				return nil, ErrTrialNotEligible
 			}
 		}
+		applyTrial(checkoutParams, trial)
+	}
+
+	// The tax may create the customer of the user, every check that can refuse the checkout runs before
+	err = s.applyTax(ctx, checkoutParams, request.UserId, request.Country, customers)
+	if err != nil {
+		return nil, err
 	}
 
-	sessionData, err := session.New(checkoutParams)
+	ctx, done := startStripeCall(ctx, "CreateCheckoutSession")
+	checkoutParams.Context = ctx
+	sessionData, err := s.client(ctx).CheckoutSessions.New(checkoutParams)
+	done(err)
 	if err != nil {
-		log.Printf("Error creating checkout: %v", err)
+		logger.FromContext(ctx).Error("error creating checkout", "productId", productData.ID, "error", err)
 		return nil, ErrorCreatingCheckout
 	}
+	metrics.CheckoutSessionsCreatedTotal.WithLabelValues(productData.ID).Inc()
+	s.recordCheckout(ctx, sessionData, lines[0])
 
-	return sessionData, nil
+	return &CheckoutResult{Session: sessionData}, nil
 }
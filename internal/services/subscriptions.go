@@ -0,0 +1,367 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"process-payments/internal/logger"
+	"process-payments/internal/models"
+	"time"
+
+	"github.com/stripe/stripe-go/v82"
+)
+
+// ExistingSubscriptionPolicy tells what a checkout does when the user already has a valid subscription in the product group
+type ExistingSubscriptionPolicy string
+
+const (
+	// PolicyAllow lets the user hold several subscriptions of the group
+	PolicyAllow ExistingSubscriptionPolicy = "allow"
+	// PolicyBlock refuses the checkout and points the user to the billing portal
+	PolicyBlock ExistingSubscriptionPolicy = "block"
+	// PolicyChange refuses the checkout with the plan change of the existing subscription to the requested price,
+	// the user confirms it through the plan change routes
+	PolicyChange ExistingSubscriptionPolicy = "change"
+)
+
+// ProductSettings holds the billing rules of a product
+type ProductSettings struct {
+	// Group gathers the products a user should only hold once, such as the tiers of a plan. Defaults to the product ID.
+	Group string
+	// ExistingSubscription is the policy applied when the user already has a valid subscription in the group, block by default
+	ExistingSubscription ExistingSubscriptionPolicy
+	// TrialDays is the trial length of the product when its prices and metadata don't set one
+	TrialDays int64
+	// CardlessTrial starts trials without a payment method, TrialEndBehavior (cancel or pause) applies when none was added
+	CardlessTrial    bool
+	TrialEndBehavior string
+	// AllowPromotionCodes lets users type a promotion code on the payment page when the checkout has none
+	AllowPromotionCodes bool
+}
+
+// Existing subscription errors
+var (
+	ErrAlreadySubscribed     = errors.New("user already has a valid subscription for this product")
+	ErrCheckingSubscriptions = errors.New("error checking existing subscriptions")
+	ErrCreatingBillingPortal = errors.New("error creating billing portal session")
+)
+
+// Cancellation errors
+var (
+	ErrSubscriptionAlreadyCanceled = errors.New("subscription is already canceled")
+	ErrSubscriptionNotCanceled     = errors.New("subscription is not canceled")
+	ErrCancelingSubscription       = errors.New("error canceling subscription")
+	ErrResumingSubscription        = errors.New("error resuming subscription")
+	ErrReleasingSchedule           = errors.New("error releasing subscription schedule")
+)
+
+// Pause errors
+var (
+	ErrSubscriptionAlreadyPaused = errors.New("subscription billing is already paused")
+	ErrSubscriptionNotPaused     = errors.New("subscription billing is not paused")
+	ErrInvalidResumeDate         = errors.New("resume date must be in the future")
+	ErrPausingSubscription       = errors.New("error pausing subscription billing")
+	ErrResumingBilling           = errors.New("error resuming subscription billing")
+)
+
+// ExistingSubscriptionError is returned by GetCheckoutSession when the existing subscription policy blocks the checkout.
+// It gives the client what it needs to manage the current subscription instead.
+type ExistingSubscriptionError struct {
+	SubscriptionId string
+	ProductId      string
+	// BillingPortalURL lets the user manage the existing subscription, empty when the portal session could not be created
+	BillingPortalURL string
+	// PlanChange is the plan change to preview and confirm instead of the checkout, set by the change policy
+	PlanChange *PlanChangeOffer
+}
+
+// PlanChangeOffer is the plan change switching the existing subscription to the price of a refused checkout
+type PlanChangeOffer struct {
+	// ProductId is the product of the subscription item to change
+	ProductId string
+	PriceId   string
+	Quantity  int64
+}
+
+func (e *ExistingSubscriptionError) Error() string {
+	return fmt.Sprintf("%s: subscription %s", ErrAlreadySubscribed, e.SubscriptionId)
+}
+
+func (e *ExistingSubscriptionError) Unwrap() error {
+	return ErrAlreadySubscribed
+}
+
+// productSettings returns the billing rules of a product, with the defaults applied
+func (s *StripeService) productSettings(productId string) ProductSettings {
+	settings := s.settings.ProductSettings[productId]
+	if settings.Group == "" {
+		settings.Group = productId
+	}
+	if settings.ExistingSubscription == "" {
+		settings.ExistingSubscription = PolicyBlock
+	}
+	return settings
+}
+
+// findExistingSubscription returns a valid subscription of the user in the group of productId, nil when there is none
+func (s *StripeService) findExistingSubscription(ctx context.Context, userId, productId string) (*models.Subscription, error) {
+	subscriptions, err := s.repo.PaymentCollection.ListValidByUserId(ctx, userId)
+	if err != nil {
+		logger.FromContext(ctx).Error("error checking existing subscriptions", "error", err)
+		return nil, ErrCheckingSubscriptions
+	}
+
+	group := s.productSettings(productId).Group
+	for _, subscription := range subscriptions {
+		// One-time purchases can be bought again
+		if subscription.IsOneTime {
+			continue
+		}
+		if s.productSettings(subscription.Plan.ProductId).Group == group {
+			return subscription, nil
+		}
+	}
+	return nil, nil
+}
+
+// ownedSubscription returns the recurring subscription of a user.
+// Users can only manage their own subscriptions, other subscriptions are reported as not found.
+func (s *StripeService) ownedSubscription(ctx context.Context, userId, subscriptionId string) (*models.Subscription, error) {
+	subscriptionModel, err := s.repo.PaymentCollection.Get(ctx, subscriptionId)
+	if err != nil || subscriptionModel.UserId != userId || subscriptionModel.IsOneTime {
+		return nil, ErrSubscriptionNotFound
+	}
+	return subscriptionModel, nil
+}
+
+// CreateBillingPortalSession creates a Stripe billing portal session for a customer, returning to returnURL
+func (s *StripeService) CreateBillingPortalSession(ctx context.Context, customerId, returnURL string) (*stripe.BillingPortalSession, error) {
+	params := &stripe.BillingPortalSessionParams{
+		Customer:  stripe.String(customerId),
+		ReturnURL: stripe.String(returnURL),
+	}
+	ctx, done := startStripeCall(ctx, "CreateBillingPortalSession")
+	params.Context = ctx
+	portalSession, err := s.client(ctx).BillingPortalSessions.New(params)
+	done(err)
+
+	if err != nil {
+		logger.FromContext(ctx).Error("error creating billing portal session", "customerId", customerId, "error", err)
+		return nil, ErrCreatingBillingPortal
+	}
+
+	return portalSession, nil
+}
+
+// existingSubscriptionError builds the error answered when the policy blocks a checkout, offering planChange when it is set.
+// A missing billing portal link is logged but doesn't hide the reason of the refusal.
+func (s *StripeService) existingSubscriptionError(ctx context.Context, subscription *models.Subscription, returnURL string, planChange *PlanChangeOffer) error {
+	existingErr := &ExistingSubscriptionError{
+		SubscriptionId: subscription.SubscriptionID,
+		ProductId:      subscription.Plan.ProductId,
+		PlanChange:     planChange,
+	}
+	if subscription.User.CustomerId != "" {
+		portalSession, err := s.CreateBillingPortalSession(ctx, subscription.User.CustomerId, returnURL)
+		if err == nil {
+			existingErr.BillingPortalURL = portalSession.URL
+		}
+	}
+	return existingErr
+}
+
+// CancelSubscription cancels a subscription of the user at the end of its current period.
+// The subscription is marked as canceled right away, it keeps granting access until the period ends.
+func (s *StripeService) CancelSubscription(ctx context.Context, userId, subscriptionId string, cancellation models.CancellationInSubscription) (*models.Subscription, error) {
+	ctx = logger.With(ctx, "subscriptionId", subscriptionId)
+	log := logger.FromContext(ctx)
+
+	subscriptionModel, err := s.ownedSubscription(ctx, userId, subscriptionId)
+	if err != nil {
+		return nil, err
+	}
+	if subscriptionModel.IsCanceled {
+		return nil, ErrSubscriptionAlreadyCanceled
+	}
+
+	// A subscription driven by a schedule can't be canceled at period end, the scheduled plan change is dropped
+	if subscriptionModel.Plan.ScheduledChange != nil {
+		err := s.releaseSchedule(ctx, subscriptionModel.Plan.ScheduledChange.ScheduleId)
+		if err != nil {
+			return nil, err
+		}
+		subscriptionModel.Plan.ScheduledChange = nil
+	}
+
+	params := &stripe.SubscriptionParams{
+		CancelAtPeriodEnd:   stripe.Bool(true),
+		CancellationDetails: &stripe.SubscriptionCancellationDetailsParams{},
+	}
+	if cancellation.Reason != "" {
+		params.CancellationDetails.Feedback = stripe.String(cancellation.Reason)
+	}
+	if cancellation.Feedback != "" {
+		params.CancellationDetails.Comment = stripe.String(cancellation.Feedback)
+	}
+	callCtx, done := startStripeCall(ctx, "CancelSubscription")
+	params.Context = callCtx
+	_, err = s.client(ctx).Subscriptions.Update(subscriptionId, params)
+	done(err)
+	if err != nil {
+		log.Error("error canceling subscription", "error", err)
+		return nil, ErrCancelingSubscription
+	}
+
+	cancellation.RequestedAt = time.Now().UnixMilli()
+	subscriptionModel.IsCanceled = true
+	subscriptionModel.Cancellation = &cancellation
+	subscriptionModel.UpdatedAt = time.Now().UnixMilli()
+	err = s.repo.PaymentCollection.Update(ctx, subscriptionModel)
+	if err != nil {
+		log.Error("error updating payment", "error", err)
+		return nil, err
+	}
+
+	return subscriptionModel, nil
+}
+
+// ResumeSubscription undoes the cancellation of a subscription of the user before its period ends
+func (s *StripeService) ResumeSubscription(ctx context.Context, userId, subscriptionId string) (*models.Subscription, error) {
+	ctx = logger.With(ctx, "subscriptionId", subscriptionId)
+	log := logger.FromContext(ctx)
+
+	subscriptionModel, err := s.ownedSubscription(ctx, userId, subscriptionId)
+	if err != nil {
+		return nil, err
+	}
+	if !subscriptionModel.IsCanceled {
+		return nil, ErrSubscriptionNotCanceled
+	}
+
+	params := &stripe.SubscriptionParams{
+		CancelAtPeriodEnd: stripe.Bool(false),
+	}
+	callCtx, done := startStripeCall(ctx, "ResumeSubscription")
+	params.Context = callCtx
+	subscriptionData, err := s.client(ctx).Subscriptions.Update(subscriptionId, params)
+	done(err)
+	if err != nil {
+		log.Error("error resuming subscription", "error", err)
+		return nil, ErrResumingSubscription
+	}
+
+	subscriptionModel.IsCanceled = subscriptionData.CancelAtPeriodEnd
+	subscriptionModel.Cancellation = nil
+	subscriptionModel.UpdatedAt = time.Now().UnixMilli()
+	err = s.repo.PaymentCollection.Update(ctx, subscriptionModel)
+	if err != nil {
+		log.Error("error updating payment", "error", err)
+		return nil, err
+	}
+
+	return subscriptionModel, nil
+}
+
+// releaseSchedule detaches a subscription schedule from its subscription, the subscription keeps its current plan
+func (s *StripeService) releaseSchedule(ctx context.Context, scheduleId string) error {
+	params := &stripe.SubscriptionScheduleReleaseParams{}
+	ctx, done := startStripeCall(ctx, "ReleaseSubscriptionSchedule")
+	params.Context = ctx
+	_, err := s.client(ctx).SubscriptionSchedules.Release(scheduleId, params)
+	done(err)
+
+	if err != nil {
+		logger.FromContext(ctx).Error("error releasing subscription schedule", "scheduleId", scheduleId, "error", err)
+		return ErrReleasingSchedule
+	}
+
+	return nil
+}
+
+// PauseBilling pauses the payment collection of a subscription of the user.
+// behavior is void, keep_as_draft or mark_uncollectible, billing resumes automatically at resumesAt unless it is zero.
+func (s *StripeService) PauseBilling(ctx context.Context, userId, subscriptionId, behavior string, resumesAt time.Time) (*models.Subscription, error) {
+	ctx = logger.With(ctx, "subscriptionId", subscriptionId)
+	log := logger.FromContext(ctx)
+
+	subscriptionModel, err := s.ownedSubscription(ctx, userId, subscriptionId)
+	if err != nil {
+		return nil, err
+	}
+	if subscriptionModel.Pause != nil {
+		return nil, ErrSubscriptionAlreadyPaused
+	}
+	if !resumesAt.IsZero() && !resumesAt.After(time.Now()) {
+		return nil, ErrInvalidResumeDate
+	}
+
+	params := &stripe.SubscriptionParams{
+		PauseCollection: &stripe.SubscriptionPauseCollectionParams{
+			Behavior: stripe.String(behavior),
+		},
+	}
+	if !resumesAt.IsZero() {
+		params.PauseCollection.ResumesAt = stripe.Int64(resumesAt.Unix())
+	}
+	callCtx, done := startStripeCall(ctx, "PauseSubscription")
+	params.Context = callCtx
+	_, err = s.client(ctx).Subscriptions.Update(subscriptionId, params)
+	done(err)
+	if err != nil {
+		log.Error("error pausing subscription", "error", err)
+		return nil, ErrPausingSubscription
+	}
+
+	subscriptionModel.Pause = &models.PauseInSubscription{
+		Behavior:     behavior,
+		PausedAt:     time.Now().UnixMilli(),
+		AccessEndsAt: subscriptionModel.EndsAt,
+	}
+	if !resumesAt.IsZero() {
+		subscriptionModel.Pause.ResumesAt = resumesAt.UnixMilli()
+	}
+	subscriptionModel.UpdatedAt = time.Now().UnixMilli()
+	err = s.repo.PaymentCollection.Update(ctx, subscriptionModel)
+	if err != nil {
+		log.Error("error updating payment", "error", err)
+		return nil, err
+	}
+
+	return subscriptionModel, nil
+}
+
+// ResumeBilling resumes the payment collection of a paused subscription of the user
+func (s *StripeService) ResumeBilling(ctx context.Context, userId, subscriptionId string) (*models.Subscription, error) {
+	ctx = logger.With(ctx, "subscriptionId", subscriptionId)
+	log := logger.FromContext(ctx)
+
+	subscriptionModel, err := s.ownedSubscription(ctx, userId, subscriptionId)
+	if err != nil {
+		return nil, err
+	}
+	if subscriptionModel.Pause == nil {
+		return nil, ErrSubscriptionNotPaused
+	}
+
+	params := &stripe.SubscriptionParams{}
+	// An empty pause_collection unsets it
+	params.AddExtra("pause_collection", "")
+	callCtx, done := startStripeCall(ctx, "ResumeSubscriptionBilling")
+	params.Context = callCtx
+	_, err = s.client(ctx).Subscriptions.Update(subscriptionId, params)
+	done(err)
+	if err != nil {
+		log.Error("error resuming subscription billing", "error", err)
+		return nil, ErrResumingBilling
+	}
+
+	subscriptionModel.Pause = nil
+	subscriptionModel.UpdatedAt = time.Now().UnixMilli()
+	err = s.repo.PaymentCollection.Update(ctx, subscriptionModel)
+	if err != nil {
+		log.Error("error updating payment", "error", err)
+		return nil, err
+	}
+
+	return subscriptionModel, nil
+}
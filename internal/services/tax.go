@@ -0,0 +1,122 @@
+package services
+
+import (
+	"context"
+	"process-payments/internal/models"
+
+	"github.com/stripe/stripe-go/v82"
+)
+
+// TaxSettings enables Stripe Tax on checkouts, both are off by default
+type TaxSettings struct {
+	// Automatic calculates the tax from the billing address of the customer
+	Automatic bool
+	// CollectTaxIds lets businesses give their tax ID, such as an EU VAT number, to be invoiced without VAT when it applies
+	CollectTaxIds bool
+}
+
+// enabled tells whether checkouts collect the billing address for the tax
+func (t TaxSettings) enabled() bool {
+	return t.Automatic || t.CollectTaxIds
+}
+
+// applyTax enables Stripe Tax on a checkout. The billing address is collected and saved on the Stripe customer of the user,
+// created when the user has none, so that renewals are taxed from the same address. customers are the customers of the user.
+// A customer already set on the checkout, such as the customer a promotion code is reserved to, is kept.
+func (s *StripeService) applyTax(ctx context.Context, checkoutParams *stripe.CheckoutSessionParams, userId, country string, customers []*stripe.Customer) error {
+	tax := s.settings.Tax
+	if !tax.enabled() {
+		return nil
+	}
+
+	if tax.Automatic {
+		checkoutParams.AutomaticTax = &stripe.CheckoutSessionAutomaticTaxParams{
+			Enabled: stripe.Bool(true),
+		}
+	}
+	if tax.CollectTaxIds {
+		checkoutParams.TaxIDCollection = &stripe.CheckoutSessionTaxIDCollectionParams{
+			Enabled: stripe.Bool(true),
+		}
+	}
+	checkoutParams.BillingAddressCollection = stripe.String(string(stripe.CheckoutSessionBillingAddressCollectionRequired))
+
+	if checkoutParams.Customer == nil {
+		if len(customers) > 0 {
+			checkoutParams.Customer = stripe.String(customers[0].ID)
+		} else {
+			customerData, err := s.CreateCustomer(ctx, userId, country)
+			if err != nil {
+				return err
+			}
+			checkoutParams.Customer = stripe.String(customerData.ID)
+		}
+	}
+	// Tax IDs are saved on the customer with its name, the business name
+	checkoutParams.CustomerUpdate = &stripe.CheckoutSessionCustomerUpdateParams{
+		Address: stripe.String("auto"),
+		Name:    stripe.String("auto"),
+	}
+	return nil
+}
+
+// taxFromInvoice returns the tax of an invoice and the tax IDs of its customer, nil when it has neither
+func taxFromInvoice(invoice *stripe.Invoice) *models.TaxInSubscription {
+	if len(invoice.TotalTaxes) == 0 && len(invoice.CustomerTaxIDs) == 0 {
+		return nil
+	}
+
+	tax := &models.TaxInSubscription{
+		AmountExcludingTax: float32(invoice.TotalExcludingTax) / 100,
+		Currency:           string(invoice.Currency),
+	}
+	for _, totalTax := range invoice.TotalTaxes {
+		tax.Amount += float32(totalTax.Amount) / 100
+	}
+	if invoice.CustomerAddress != nil {
+		tax.Country = invoice.CustomerAddress.Country
+	}
+	if invoice.CustomerTaxExempt != nil {
+		tax.TaxExempt = string(*invoice.CustomerTaxExempt)
+	}
+	for _, taxId := range invoice.CustomerTaxIDs {
+		customerTaxId := models.TaxIdInSubscription{Value: taxId.Value}
+		if taxId.Type != nil {
+			customerTaxId.Type = string(*taxId.Type)
+		}
+		tax.CustomerTaxIds = append(tax.CustomerTaxIds, customerTaxId)
+	}
+	return tax
+}
+
+// taxFromSession returns the tax of a completed checkout and the tax IDs given by the customer, nil when it has neither
+func taxFromSession(checkoutSession stripe.CheckoutSession) *models.TaxInSubscription {
+	automatic := checkoutSession.AutomaticTax != nil && checkoutSession.AutomaticTax.Enabled
+	details := checkoutSession.CustomerDetails
+	if !automatic && (details == nil || len(details.TaxIDs) == 0) {
+		return nil
+	}
+
+	var amountTax int64
+	if checkoutSession.TotalDetails != nil {
+		amountTax = checkoutSession.TotalDetails.AmountTax
+	}
+	tax := &models.TaxInSubscription{
+		Amount:             float32(amountTax) / 100,
+		AmountExcludingTax: float32(checkoutSession.AmountTotal-amountTax) / 100,
+		Currency:           string(checkoutSession.Currency),
+	}
+	if details != nil {
+		if details.Address != nil {
+			tax.Country = details.Address.Country
+		}
+		tax.TaxExempt = string(details.TaxExempt)
+		for _, taxId := range details.TaxIDs {
+			tax.CustomerTaxIds = append(tax.CustomerTaxIds, models.TaxIdInSubscription{
+				Type:  string(taxId.Type),
+				Value: taxId.Value,
+			})
+		}
+	}
+	return tax
+}
@@ -0,0 +1,183 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"process-payments/internal/logger"
+	"process-payments/internal/models"
+	"process-payments/internal/repository"
+
+	"github.com/stripe/stripe-go/v82"
+)
+
+// Trial eligibility errors
+var (
+	ErrTrialNotEligible         = errors.New("user is not eligible for a trial")
+	ErrCheckingTrialEligibility = errors.New("error checking trial eligibility")
+	ErrEndingTrial              = errors.New("error ending trial")
+)
+
+// TrialEligibility tells whether a user can start a trial and why
+type TrialEligibility struct {
+	Eligible bool `json:"eligible"`
+	// Reason is override when an admin decided, used when an identity of the user already had a trial
+	Reason   string                `json:"reason,omitempty"`
+	Override *models.TrialOverride `json:"override,omitempty"`
+}
+
+// CheckTrialEligibility checks the admin override of the user, then the trial usages of the identities
+func (s *StripeService) CheckTrialEligibility(ctx context.Context, userId string, identities ...models.TrialIdentity) (*TrialEligibility, error) {
+	log := logger.FromContext(ctx)
+
+	override, err := s.repo.TrialCollection.GetOverride(ctx, userId)
+	if err == nil {
+		return &TrialEligibility{Eligible: override.Eligible, Reason: "override", Override: override}, nil
+	}
+	if !errors.Is(err, repository.ErrTrialOverrideNotFound) {
+		log.Error("error getting trial override", "error", err)
+		return nil, ErrCheckingTrialEligibility
+	}
+
+	identities = append(identities, models.TrialIdentity{Kind: models.TrialIdentityUser, Value: userId})
+	_, err = s.repo.TrialCollection.FindUsage(ctx, identities)
+	if errors.Is(err, repository.ErrTrialUsageNotFound) {
+		return &TrialEligibility{Eligible: true}, nil
+	}
+	if err != nil {
+		log.Error("error finding trial usage", "error", err)
+		return nil, ErrCheckingTrialEligibility
+	}
+	return &TrialEligibility{Eligible: false, Reason: "used"}, nil
+}
+
+// UserTrialEligibility checks the trial eligibility of a user under its id and the identities of its Stripe customers
+// Search errors are logged and skipped, the card fingerprint is checked again when the checkout completes.
+func (s *StripeService) UserTrialEligibility(ctx context.Context, userId string) (*TrialEligibility, error) {
+	customers, err := s.userCustomers(ctx, userId)
+	if err != nil {
+		logger.FromContext(ctx).Warn("error searching customers of the user", "error", err)
+	}
+	return s.CheckTrialEligibility(ctx, userId, customerIdentities(customers)...)
+}
+
+// customerIdentities returns the Stripe customer and email identities of the customers of a user
+func customerIdentities(customers []*stripe.Customer) []models.TrialIdentity {
+	var identities []models.TrialIdentity
+	for _, customer := range customers {
+		identities = append(identities,
+			models.TrialIdentity{Kind: models.TrialIdentityCustomer, Value: customer.ID},
+			models.TrialIdentity{Kind: models.TrialIdentityEmail, Value: customer.Email},
+		)
+	}
+	return identities
+}
+
+// userCustomers returns the Stripe customers of a user, none when the user is not a customer yet or is anonymous.
+// Customer Search is rate limited and eventually consistent, a request searches the customers once and passes them down.
+func (s *StripeService) userCustomers(ctx context.Context, userId string) ([]*stripe.Customer, error) {
+	if userId == "" {
+		return nil, nil
+	}
+	params := &stripe.CustomerSearchParams{
+		SearchParams: stripe.SearchParams{
+			Query: "metadata['userId']:'" + userId + "'",
+		},
+	}
+	ctx, done := startStripeCall(ctx, "SearchCustomers")
+	params.Context = ctx
+	result := s.client(ctx).Customers.Search(params)
+	customers := result.CustomerSearchResult().Data
+	done(result.Err())
+	if result.Err() != nil {
+		return nil, result.Err()
+	}
+
+	// The search index may lag, make sure every customer belongs to the user
+	owned := make([]*stripe.Customer, 0, len(customers))
+	for _, customer := range customers {
+		if customer.Metadata["userId"] == userId {
+			owned = append(owned, customer)
+		}
+	}
+	return owned, nil
+}
+
+// recordTrialUsage records the trial of a completed checkout under every identity of the user.
+// When the card was already used for a trial by another user, the trial is ended right away unless an admin allowed it.
+// It can run again for the same checkout, usages are only recorded once and an ended trial is not ended again.
+func (s *StripeService) recordTrialUsage(ctx context.Context, userId string, customer *stripe.Customer, subscription *stripe.Subscription) error {
+	log := logger.FromContext(ctx)
+
+	identities := []models.TrialIdentity{
+		{Kind: models.TrialIdentityUser, Value: userId},
+		{Kind: models.TrialIdentityCustomer, Value: customer.ID},
+		{Kind: models.TrialIdentityEmail, Value: customer.Email},
+	}
+	fingerprint := s.cardFingerprint(ctx, subscription)
+	if fingerprint != "" {
+		card := models.TrialIdentity{Kind: models.TrialIdentityCardFingerprint, Value: fingerprint}
+		identities = append(identities, card)
+
+		usage, err := s.repo.TrialCollection.FindUsage(ctx, []models.TrialIdentity{card})
+		if err == nil && usage.UserId != userId {
+			override, err := s.repo.TrialCollection.GetOverride(ctx, userId)
+			if err != nil && !errors.Is(err, repository.ErrTrialOverrideNotFound) {
+				log.Error("error getting trial override", "error", err)
+				return ErrCheckingTrialEligibility
+			}
+			// The trial may already be ended by a previous attempt of the fulfillment
+			if (override == nil || !override.Eligible) && subscription.Status == stripe.SubscriptionStatusTrialing {
+				log.Warn("card already used for a trial, ending the trial", "trialUsedBy", usage.UserId)
+				if err := s.endTrial(ctx, subscription.ID); err != nil {
+					return err
+				}
+			}
+		} else if err != nil && !errors.Is(err, repository.ErrTrialUsageNotFound) {
+			log.Error("error finding trial usage", "error", err)
+		}
+	}
+
+	err := s.repo.TrialCollection.RecordUsage(ctx, identities, userId, subscription.ID)
+	if err != nil {
+		log.Error("error recording trial usage", "error", err)
+		return err
+	}
+	return nil
+}
+
+// cardFingerprint returns the fingerprint of the card paying a subscription, empty when it has no card
+func (s *StripeService) cardFingerprint(ctx context.Context, subscription *stripe.Subscription) string {
+	if subscription.DefaultPaymentMethod == nil {
+		return ""
+	}
+	params := &stripe.PaymentMethodParams{}
+	ctx, done := startStripeCall(ctx, "GetPaymentMethod")
+	params.Context = ctx
+	paymentMethod, err := s.client(ctx).PaymentMethods.Get(subscription.DefaultPaymentMethod.ID, params)
+	done(err)
+	if err != nil {
+		logger.FromContext(ctx).Warn("error getting payment method", "paymentMethodId", subscription.DefaultPaymentMethod.ID, "error", err)
+		return ""
+	}
+	if paymentMethod.Card == nil {
+		return ""
+	}
+	return paymentMethod.Card.Fingerprint
+}
+
+// endTrial ends the trial of a subscription now, the first invoice is created right away
+func (s *StripeService) endTrial(ctx context.Context, subscriptionId string) error {
+	params := &stripe.SubscriptionParams{
+		TrialEndNow:       stripe.Bool(true),
+		ProrationBehavior: stripe.String(ProrationNone),
+	}
+	ctx, done := startStripeCall(ctx, "EndTrial")
+	params.Context = ctx
+	_, err := s.client(ctx).Subscriptions.Update(subscriptionId, params)
+	done(err)
+	if err != nil {
+		logger.FromContext(ctx).Error("error ending trial", "subscriptionId", subscriptionId, "error", err)
+		return ErrEndingTrial
+	}
+	return nil
+}
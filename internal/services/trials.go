@@ -0,0 +1,132 @@
+package services
+
+import (
+	"context"
+	"process-payments/internal/logger"
+	"strconv"
+	"time"
+
+	"github.com/stripe/stripe-go/v82"
+)
+
+// Trial end behaviors of card-less trials, applied when no payment method was added before the trial ends
+const (
+	TrialEndCancel = "cancel"
+	TrialEndPause  = "pause"
+)
+
+// Trial metadata keys, read on the price first, then on the product
+const (
+	metadataTrial            = "trial"
+	metadataTrialDays        = "trial_days"
+	metadataTrialCardless    = "trial_cardless"
+	metadataTrialEndBehavior = "trial_end_behavior"
+)
+
+// trialPolicy is the trial granted on the checkout of a price
+type trialPolicy struct {
+	// Days is the trial length, no trial is granted when it is zero
+	Days int64
+	// Cardless trials start without a payment method, EndBehavior tells what happens when none was added when the trial ends
+	Cardless    bool
+	EndBehavior string
+}
+
+// trialPolicy returns the trial granted on a price, from the first of:
+// the price metadata, the product metadata, the product settings and the default trial length for products with the trial metadata.
+func (s *StripeService) trialPolicy(ctx context.Context, product *stripe.Product, price *stripe.Price) trialPolicy {
+	settings := s.productSettings(product.ID)
+	policy := trialPolicy{
+		Cardless:    settings.CardlessTrial,
+		EndBehavior: settings.TrialEndBehavior,
+	}
+
+	days, found := metadataTrialDaysValue(ctx, price.Metadata)
+	if !found {
+		days, found = metadataTrialDaysValue(ctx, product.Metadata)
+	}
+	switch {
+	case found:
+		policy.Days = days
+	case settings.TrialDays > 0:
+		policy.Days = settings.TrialDays
+	case price.Metadata[metadataTrial] == "true" || product.Metadata[metadataTrial] == "true":
+		policy.Days = s.settings.TrialDays
+	}
+
+	for _, metadata := range []map[string]string{product.Metadata, price.Metadata} {
+		if value, ok := metadata[metadataTrialCardless]; ok {
+			policy.Cardless = value == "true"
+		}
+		if value := metadata[metadataTrialEndBehavior]; value == TrialEndCancel || value == TrialEndPause {
+			policy.EndBehavior = value
+		}
+	}
+	if policy.EndBehavior == "" {
+		policy.EndBehavior = TrialEndCancel
+	}
+
+	return policy
+}
+
+// metadataTrialDaysValue reads the trial_days metadata, malformed values are logged and ignored
+func metadataTrialDaysValue(ctx context.Context, metadata map[string]string) (int64, bool) {
+	value, ok := metadata[metadataTrialDays]
+	if !ok {
+		return 0, false
+	}
+	days, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || days < 0 {
+		logger.FromContext(ctx).Warn("invalid trial_days metadata", "value", value)
+		return 0, false
+	}
+	return days, true
+}
+
+// applyTrial adds the trial of a price to the checkout of a subscription
+func applyTrial(checkoutParams *stripe.CheckoutSessionParams, trial trialPolicy) {
+	if trial.Days <= 0 {
+		return
+	}
+	if checkoutParams.SubscriptionData == nil {
+		checkoutParams.SubscriptionData = &stripe.CheckoutSessionSubscriptionDataParams{}
+	}
+	checkoutParams.SubscriptionData.TrialPeriodDays = stripe.Int64(trial.Days)
+
+	if trial.Cardless {
+		checkoutParams.PaymentMethodCollection = stripe.String("if_required")
+		checkoutParams.SubscriptionData.TrialSettings = &stripe.CheckoutSessionSubscriptionDataTrialSettingsParams{
+			EndBehavior: &stripe.CheckoutSessionSubscriptionDataTrialSettingsEndBehaviorParams{
+				MissingPaymentMethod: stripe.String(trial.EndBehavior),
+			},
+		}
+	}
+}
+
+// handleTrialWillEnd notifies the user three days before the end of a trial
+func (s *StripeService) handleTrialWillEnd(ctx context.Context, subscription stripe.Subscription) error {
+	ctx = logger.With(ctx, "subscriptionId", subscription.ID)
+	log := logger.FromContext(ctx)
+
+	subscriptionData, err := s.repo.PaymentCollection.Get(ctx, subscription.ID)
+	if err != nil {
+		log.Error("error getting subscription", "error", err)
+		return ErrSubscriptionNotFound
+	}
+	if subscriptionData.TrialEndsAt != subscription.TrialEnd*1000 {
+		subscriptionData.TrialEndsAt = subscription.TrialEnd * 1000
+		subscriptionData.UpdatedAt = time.Now().UnixMilli()
+		if err := s.repo.PaymentCollection.Update(ctx, subscriptionData); err != nil {
+			log.Error("error updating payment", "error", err)
+			return err
+		}
+	}
+
+	err = s.notifier.TrialWillEnd(ctx, subscriptionData, time.Unix(subscription.TrialEnd, 0))
+	if err != nil {
+		log.Error("error notifying trial end", "error", err)
+		return err
+	}
+
+	return nil
+}
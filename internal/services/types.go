@@ -2,4 +2,5 @@ package services
 
 type Services struct {
 	StripeService *StripeService
+	WebhookQueue  *WebhookQueue
 }
@@ -0,0 +1,108 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"process-payments/internal/logger"
+	"process-payments/internal/metrics"
+	"sync"
+
+	"github.com/stripe/stripe-go/v82"
+)
+
+// saturationRatio is the queue fill ratio from which the queue is considered saturated
+const saturationRatio = 0.9
+
+var ErrWebhookQueueFull = errors.New("webhook queue is full")
+
+type queuedEvent struct {
+	ctx   context.Context
+	event stripe.Event
+}
+
+// WebhookQueue handles Stripe webhook events in the background with a bounded number of workers.
+type WebhookQueue struct {
+	events  chan queuedEvent
+	handler func(context.Context, stripe.Event) error
+	workers int
+	wg      sync.WaitGroup
+}
+
+// NewWebhookQueue creates a queue holding up to size events, handled by the given number of workers
+func NewWebhookQueue(handler func(context.Context, stripe.Event) error, workers, size int) *WebhookQueue {
+	return &WebhookQueue{
+		events:  make(chan queuedEvent, size),
+		handler: handler,
+		workers: workers,
+	}
+}
+
+// Start launches the queue workers
+func (q *WebhookQueue) Start() {
+	for i := 0; i < q.workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+}
+
+// Enqueue adds an event to the queue without blocking. It returns ErrWebhookQueueFull when there is no room left.
+func (q *WebhookQueue) Enqueue(ctx context.Context, e stripe.Event) error {
+	select {
+	case q.events <- queuedEvent{ctx: ctx, event: e}:
+		return nil
+	default:
+		return ErrWebhookQueueFull
+	}
+}
+
+// Len returns the number of events waiting to be handled
+func (q *WebhookQueue) Len() int {
+	return len(q.events)
+}
+
+// Cap returns the maximum number of events the queue can hold
+func (q *WebhookQueue) Cap() int {
+	return cap(q.events)
+}
+
+// Saturated reports whether the queue is close to full
+func (q *WebhookQueue) Saturated() bool {
+	return float64(q.Len()) >= float64(q.Cap())*saturationRatio
+}
+
+// Stop stops accepting events and waits for the queued ones to be handled, or for ctx to be done
+func (q *WebhookQueue) Stop(ctx context.Context) error {
+	close(q.events)
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *WebhookQueue) work() {
+	defer q.wg.Done()
+	for queued := range q.events {
+		ctx, e := queued.ctx, queued.event
+		eventType := string(e.Type)
+
+		err := q.handler(ctx, e)
+		switch {
+		case err == nil:
+			metrics.WebhookEventsTotal.WithLabelValues(eventType, metrics.WebhookProcessed).Inc()
+		case errors.Is(err, ErrorHandlingStripeEvent):
+			metrics.WebhookEventsTotal.WithLabelValues(eventType, metrics.WebhookIgnored).Inc()
+		default:
+			metrics.WebhookEventsTotal.WithLabelValues(eventType, metrics.WebhookFailed).Inc()
+			logger.FromContext(ctx).Error("error handling stripe event", "eventId", e.ID, "eventType", eventType, "error", err)
+		}
+	}
+}
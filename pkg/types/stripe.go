@@ -1,7 +1,89 @@
 package types
 
+import "time"
+
 type StripeCheckoutRequest struct {
 	ProductId string
+	// PriceId is one of the product prices, the product default price is used when empty
+	PriceId  string
+	Quantity int64
+	// Items are bought along with ProductId, such as add-ons and seat packs. Without ProductId, the first item is the main one.
+	Items         []CheckoutItem
+	PromotionCode string
+	// Country is the country chosen by the client. The country prices are picked for falls back to the billing address
+	// of the user, then to IPCountry, the country of the client IP set by our CDN.
+	Country   string
+	IPCountry string
 	UserId    string
-	ReturnURL string
+	// UIMode is hosted (default) or embedded. Embedded checkouts send the user to ReturnURL, holding {CHECKOUT_SESSION_ID},
+	// CancelURL is still the return URL of the billing portal.
+	UIMode         string
+	ReturnURL      string
+	SuccessURL     string
+	CancelURL      string
+	IdempotencyKey string
+}
+
+// CheckoutItem is a line of a checkout cart
+type CheckoutItem struct {
+	// ProductId uses the product default price when PriceId is empty
+	ProductId string `json:"productId"`
+	PriceId   string `json:"priceId" binding:"required_without=ProductId"`
+	Quantity  int64  `json:"quantity" binding:"omitempty,min=1,max=100"`
+	// MinQuantity and MaxQuantity let the user adjust the quantity on the payment page when MaxQuantity is set
+	MinQuantity int64 `json:"minQuantity" binding:"omitempty,min=0,max=999"`
+	MaxQuantity int64 `json:"maxQuantity" binding:"omitempty,min=1,max=999"`
+}
+
+// CreateCheckoutBody is the JSON body of the checkout creation endpoint
+type CreateCheckoutBody struct {
+	ProductId string         `json:"productId" binding:"required_without=Items"`
+	PriceId   string         `json:"priceId"`
+	Quantity  int64          `json:"quantity" binding:"omitempty,min=1,max=100"`
+	Items     []CheckoutItem `json:"items" binding:"omitempty,max=20,dive"`
+	PromoCode string         `json:"promoCode"`
+	// Country picks the regional prices, the billing address or the CDN country is used when empty
+	Country string `json:"country" binding:"omitempty,iso3166_1_alpha2"`
+	// SuccessPath and CancelPath are paths of the client application, /account when empty.
+	// SuccessURL and CancelURL replace them with paths or URLs of the allowed origins, such as mobile deep links.
+	SuccessPath string `json:"successPath"`
+	CancelPath  string `json:"cancelPath"`
+	SuccessURL  string `json:"successUrl"`
+	CancelURL   string `json:"cancelUrl"`
+	// UIMode is hosted or embedded, the user comes back to ReturnURL or ReturnPath from an embedded checkout
+	UIMode     string `json:"uiMode" binding:"omitempty,oneof=hosted embedded"`
+	ReturnPath string `json:"returnPath"`
+	ReturnURL  string `json:"returnUrl"`
+}
+
+// ChangePlanBody is the JSON body of the plan change endpoints
+type ChangePlanBody struct {
+	// ItemId or ProductId names the subscription item to change
+	ItemId    string `json:"itemId" binding:"required_without=ProductId"`
+	ProductId string `json:"productId" binding:"required_without=ItemId"`
+	PriceId   string `json:"priceId" binding:"required"`
+	// Quantity keeps the current quantity when empty
+	Quantity int64 `json:"quantity" binding:"omitempty,min=1,max=100"`
+	// Timing is now (default) or period_end
+	Timing string `json:"timing" binding:"omitempty,oneof=now period_end"`
+}
+
+// CancelSubscriptionBody is the JSON body of the subscription cancellation endpoint
+type CancelSubscriptionBody struct {
+	Reason   string `json:"reason" binding:"omitempty,oneof=customer_service low_quality missing_features other switched_service too_complex too_expensive unused"`
+	Feedback string `json:"feedback" binding:"max=2000"`
+}
+
+// PauseBillingBody is the JSON body of the subscription billing pause endpoint
+type PauseBillingBody struct {
+	// Behavior is what happens to the invoices while paused: void (default), keep_as_draft or mark_uncollectible
+	Behavior string `json:"behavior" binding:"omitempty,oneof=void keep_as_draft mark_uncollectible"`
+	// ResumesAt is an optional RFC 3339 date at which billing resumes automatically
+	ResumesAt time.Time `json:"resumesAt"`
+}
+
+// TrialOverrideBody is the JSON body of the trial eligibility override endpoint
+type TrialOverrideBody struct {
+	Eligible *bool  `json:"eligible" binding:"required"`
+	Reason   string `json:"reason" binding:"max=500"`
 }